@@ -1,24 +1,37 @@
 module update-hosts-file
 
-go 1.20
+go 1.22
 
 require github.com/spf13/cobra v1.7.0
 
-require github.com/fatih/color v1.15.0
-
 require github.com/AlecAivazis/survey/v2 v2.3.6
 
+require github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
+
+require github.com/andybalholm/brotli v1.1.1
+
+require github.com/jedisct1/go-minisign v0.0.0-20230811132847-661be99b8267
+
+require github.com/ulikunitz/xz v0.5.12
+
+require github.com/klauspost/compress v1.18.0
+
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/gookit/color v1.5.4
+	golang.org/x/crypto v0.17.0
+	golang.org/x/net v0.12.0
+)
+
 require (
-	github.com/gookit/color v1.5.4 // indirect
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/xo/terminfo v0.0.0-20210125001918-ca9a967f8778 // indirect
-	golang.org/x/crypto v0.12.0 // indirect
-	golang.org/x/sys v0.11.0 // indirect
-	golang.org/x/term v0.11.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/term v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
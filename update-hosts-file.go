@@ -15,29 +15,54 @@ package main
 
 import (
 	// Modules in GOROOT
+	"archive/tar"
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"sort"
 	"errors"
 	"log"
+	"net"
+	"net/netip"
 	"net/http"
+	"net/url"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"math/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 
 	// External modules
 	cobra "github.com/spf13/cobra"
 	color "github.com/gookit/color"
 	survey "github.com/AlecAivazis/survey/v2"
+	shellquote "github.com/kballard/go-shellquote"
 	terminal "golang.org/x/crypto/ssh/terminal"
+	brotli "github.com/andybalholm/brotli"
+	minisign "github.com/jedisct1/go-minisign"
+	xz "github.com/ulikunitz/xz"
+	zstd "github.com/klauspost/compress/zstd"
+	openpgp "github.com/ProtonMail/go-crypto/openpgp"
+	idna "golang.org/x/net/idna"
 
 	// Unused modules
 	_"runtime/debug"
@@ -65,8 +90,13 @@ var (
 	modulesDir      = programDir + "/modules"
 	localModulesDir = modulesDir + "/local"
 	webModulesDir   = modulesDir + "/web"
+	execModulesDir  = modulesDir + "/exec"
+	allowlistDir    = modulesDir + "/allow"
 	configDir       = programDir + "/config"
+	credentialsDir  = configDir + "/credentials"
 	backupDir       = programDir + "/backup"
+	cacheDir        = programDir + "/cache"
+	webCacheDir     = cacheDir + "/web"
 	hostsFile       = "/etc/hosts"
 )
 
@@ -207,8 +237,8 @@ func getConfigValue(key string) (string, error) {
 	scanner := bufio.NewScanner(configFile)
   for scanner.Scan() {
 		line := scanner.Text()
-		if !strings.HasPrefix(line, "#") && strings.HasPrefix(line, key) {
-			parts := strings.Split(line, "=")
+		if !strings.HasPrefix(line, "#") && strings.HasPrefix(line, key + "=") {
+			parts := strings.SplitN(line, "=", 2)
 			if len(parts) == 2 {
 				return parts[1], nil
 				} else {
@@ -226,136 +256,4367 @@ func getCurrentHostname() string {
 	return hostname
 }
 
-func downloadFile(filepath string, url string) error {
-	resp, err := http.Get(url)
+// Parses an interval such as "90m", "12h" or "7d" (days are not supported by
+// time.ParseDuration, so they are handled here)
+func parseInterval(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("invalid interval '%s'", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("invalid interval '%s'", value)
+	}
+	return interval, nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// Parses a size such as "512K", "50M" or "1G". A value without a suffix is
+// taken as a number of bytes.
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return size * multiplier, nil
+}
+
+// Returns the value of a key in the preferences file, or the default value if
+// the key is not set
+func getConfigValueOrDefault(key string, defaultValue string) string {
+	value, err := getConfigValue(key)
+	if err != nil || strings.TrimSpace(value) == "" {
+		return defaultValue
+	}
+	return strings.TrimSpace(value)
+}
+
+// Returns the value of a key in the preferences file, or the default value if
+// the key is not in the file. Unlike getConfigValueOrDefault, an empty value
+// is returned as is, for options that are disabled when left empty.
+func getOptionalConfigValue(key string, defaultValue string) string {
+	value, err := getConfigValue(key)
+	if err != nil {
+		return defaultValue
+	}
+	return strings.TrimSpace(value)
+}
+
+//
+//// HTTP CLIENT
+//
+
+type httpClientConfig struct {
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	totalTimeout   time.Duration
+	maxSize        int64
+	userAgent      string
+	httpProxy      string
+	httpsProxy     string
+	noProxy        string
+	caBundle       string
+	clientCert     string
+	clientKey      string
+	headers        http.Header
+	refusePlainHTTP bool
+}
+
+func getHTTPClientConfig() (httpClientConfig, error) {
+	config := httpClientConfig{
+		userAgent:  getConfigValueOrDefault("HTTP_USER_AGENT", fmt.Sprintf("update-hosts-file/%s", programVersion)),
+		httpProxy:  getConfigValueOrDefault("HTTP_PROXY", ""),
+		httpsProxy: getConfigValueOrDefault("HTTPS_PROXY", ""),
+		noProxy:    getConfigValueOrDefault("NO_PROXY", ""),
+		caBundle:   getConfigValueOrDefault("HTTP_CA_BUNDLE", ""),
+		clientCert: getConfigValueOrDefault("HTTP_CLIENT_CERT", ""),
+		clientKey:  getConfigValueOrDefault("HTTP_CLIENT_KEY", ""),
+	}
+
+	var err error
+	config.connectTimeout, err = parseInterval(getConfigValueOrDefault("HTTP_CONNECT_TIMEOUT", "15s"))
+	if err != nil {
+		return config, fmt.Errorf("HTTP_CONNECT_TIMEOUT: %s", err.Error())
+	}
+	config.readTimeout, err = parseInterval(getConfigValueOrDefault("HTTP_READ_TIMEOUT", "30s"))
+	if err != nil {
+		return config, fmt.Errorf("HTTP_READ_TIMEOUT: %s", err.Error())
+	}
+	config.totalTimeout, err = parseInterval(getConfigValueOrDefault("HTTP_TOTAL_TIMEOUT", "5m"))
+	if err != nil {
+		return config, fmt.Errorf("HTTP_TOTAL_TIMEOUT: %s", err.Error())
+	}
+	config.maxSize, err = parseSize(getConfigValueOrDefault("HTTP_MAX_SIZE", "100M"))
+	if err != nil {
+		return config, fmt.Errorf("HTTP_MAX_SIZE: %s", err.Error())
+	}
+	config.refusePlainHTTP, err = strconv.ParseBool(getConfigValueOrDefault("REFUSE_PLAIN_HTTP", "false"))
+	if err != nil {
+		return config, fmt.Errorf("REFUSE_PLAIN_HTTP: %s", err.Error())
+	}
+
+	return config, nil
+}
+
+// Returns the proxy to be used for a request. Proxies set in the preferences
+// file (or in the module file) take precedence over the environment variables,
+// which are not available to the systemd service.
+func getProxyFunc(config httpClientConfig) func(*http.Request) (*url.URL, error) {
+	if config.httpProxy == "" && config.httpsProxy == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if isNoProxyHost(req.URL.Hostname(), config.noProxy) {
+			return nil, nil
+		}
+
+		proxy := config.httpProxy
+		if req.URL.Scheme == "https" && config.httpsProxy != "" {
+			proxy = config.httpsProxy
+		}
+		if proxy == "" || proxy == "none" {
+			return nil, nil
+		}
+
+		return url.Parse(proxy)
+	}
+}
+
+// Verifies if a host matches the comma separated NO_PROXY list. An entry
+// matches the host itself and all of its subdomains.
+func isNoProxyHost(host string, noProxy string) bool {
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), ".")
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+func getTLSConfig(config httpClientConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if config.caBundle != "" {
+		// The bundle is added to the system certificates, so that other
+		// sources keep working
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		bundle, err := ioutil.ReadFile(config.caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %s", err.Error())
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", config.caBundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.clientCert != "" || config.clientKey != "" {
+		if config.clientCert == "" || config.clientKey == "" {
+			return nil, errors.New("both a client certificate and a client key are needed")
+		}
+		certificate, err := tls.LoadX509KeyPair(config.clientCert, config.clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+func newHTTPClient(config httpClientConfig) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout: config.connectTimeout,
+	}
+
+	tlsConfig, err := getTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:                 getProxyFunc(config),
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   config.connectTimeout,
+		ResponseHeaderTimeout: config.readTimeout,
+		// Content decoding is done by decodeResponseBody, so that brotli is
+		// supported as well
+		DisableCompression: true,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.totalTimeout,
+	}, nil
+}
+
+// Cancels the request if no data is received from the server for longer than
+// the read timeout. The timer only runs while waiting for the server: the time
+// the caller spends on the data (writing or decompressing it) does not count.
+type idleTimeoutReader struct {
+	reader  io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.reader.Read(p)
+	r.timer.Stop()
+	return n, err
+}
+
+func decodeResponseBody(resp *http.Response, body io.Reader) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+// Processes the content of a download while it is received, such as
+// decompressing it. It is given the path the content is downloaded to, and
+// writes its own output next to it: to the same path followed by '.content'.
+type downloadStream func(body io.Reader, filePath string, download downloadResult) error
+
+// Writes the content of a download to a file and, if stream is set, passes it
+// to stream at the same time
+func writeDownload(out io.Writer, body io.Reader, filePath string, stream downloadStream, download downloadResult) (int64, error) {
+	if stream == nil {
+		return io.Copy(out, body)
+	}
+
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := stream(reader, filePath, download)
+		if err == nil {
+			// The whole content is still needed in the file, to be verified
+			// and cached
+			_, err = io.Copy(ioutil.Discard, reader)
+		}
+		reader.CloseWithError(err)
+		done <- err
+	}()
+
+	written, err := io.Copy(io.MultiWriter(out, writer), body)
+	writer.CloseWithError(err)
+	streamErr := <-done
+	if err != nil {
+		return written, err
+	}
+	return written, streamErr
+}
+
+// Downloads a file and returns the Content-Type sent by the server. Local
+// sources (file:// URLs and absolute paths) are copied instead. If stream is
+// set, the content is passed to it while it is downloaded.
+func downloadFile(ctx context.Context, filepath string, url string, config httpClientConfig, stream downloadStream) (string, error) {
+	if localPath, isLocal := getLocalSourcePath(url); isLocal {
+		return "", copyLocalSource(filepath, localPath, config.maxSize, stream, downloadResult{source: url})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, values := range config.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("User-Agent", config.userAgent)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+
+	client, err := newHTTPClient(config)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Failed to download file: %s", resp.Status)
+		return "", fmt.Errorf("Failed to download file: %s", resp.Status)
+	}
+
+	if config.maxSize > 0 && resp.ContentLength > config.maxSize && resp.Header.Get("Content-Encoding") == "" {
+		return "", fmt.Errorf("Failed to download file: size of %d bytes exceeds the maximum of %d bytes", resp.ContentLength, config.maxSize)
+	}
+
+	// A read timeout of 0 disables it, like the other timeouts
+	var rawBody io.Reader = resp.Body
+	if config.readTimeout > 0 {
+		timer := time.AfterFunc(config.readTimeout, cancel)
+		defer timer.Stop()
+		rawBody = &idleTimeoutReader{reader: resp.Body, timeout: config.readTimeout, timer: timer}
+	}
+
+	body, err := decodeResponseBody(resp, rawBody)
+	if err != nil {
+		return "", fmt.Errorf("Failed to download file: %s", err.Error())
+	}
+
+	// The limit is applied to the decoded content, so that a small compressed
+	// response can not be used to fill the disk
+	if config.maxSize > 0 {
+		body = io.LimitReader(body, config.maxSize+1)
 	}
 
 	out, err := os.Create(filepath)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	written, err := writeDownload(out, body, filepath, stream, downloadResult{source: url, contentType: resp.Header.Get("Content-Type")})
 	if err != nil {
-		return err
+		if ctx.Err() != nil && config.readTimeout > 0 {
+			return "", fmt.Errorf("Failed to download file: no data received for %s", config.readTimeout)
+		}
+		return "", err
 	}
 
-	return nil
+	if config.maxSize > 0 && written > config.maxSize {
+		return "", fmt.Errorf("Failed to download file: content exceeds the maximum size of %d bytes", config.maxSize)
+	}
+
+	return resp.Header.Get("Content-Type"), nil
 }
 
+// Returns the path of a local source: a file:// URL (without host, or with
+// 'localhost' as host) or an absolute path
+func getLocalSourcePath(source string) (string, bool) {
+	if strings.HasPrefix(source, "/") {
+		return source, true
+	}
 
-//
-//// MAIN FUNCTIONS
-//
+	parsedURL, err := url.Parse(source)
+	if err != nil || parsedURL.Scheme != "file" {
+		return "", false
+	}
+	if parsedURL.Host != "" && parsedURL.Host != "localhost" {
+		return "", false
+	}
 
-func insertHostname(tmphosts_file string) {
-	showInfoSectionTitle("Inserting the hostname")
-	insertLine(tmphosts_file,"")
-	insertLine(tmphosts_file,"# Hostname")
-	insertHost(tmphosts_file,"127.0.0.1", getCurrentHostname())
-	insertLine(tmphosts_file,"")
-	showSuccess("    > Done")
+	return parsedURL.Path, true
 }
 
-func restoreBackup(backupFile backup_file) {
-	fmt.Println("")
-	showAttention("An error has occurred. Backup will be restored.")
+func copyLocalSource(filepath string, localPath string, maxSize int64, stream downloadStream, download downloadResult) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read file: %s", err.Error())
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("Failed to read file: %s is not a regular file", localPath)
+	}
+	if maxSize > 0 && info.Size() > maxSize {
+		return fmt.Errorf("Failed to read file: size of %d bytes exceeds the maximum of %d bytes", info.Size(), maxSize)
+	}
 
-	err := os.Rename(filepath.Join(backupDir, backupFile.filename), hostsFile)
+	in, err := os.Open(localPath)
 	if err != nil {
-		showError("    > Error: failed to restore backup: " + err.Error())
-		finishProgram(1)
+		return fmt.Errorf("Failed to read file: %s", err.Error())
 	}
+	defer in.Close()
 
-	showInfo("    > Hosts file restored.")
-	finishProgram(1)
+	out, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = writeDownload(out, in, filepath, stream, download)
+	return err
 }
 
+type downloadResult struct {
+	source      string
+	contentType string
+}
 
-func loadLocalModules(tmphosts_file string) error {
-	showInfoSectionTitle("Loading local modules")
-	time.Sleep(2 * time.Second)
+// Downloads a file from the first source (URL or mirror) that can be reached
+// and returns the source that served it. With the "race" strategy, all sources
+// are requested at once and the first complete download wins; otherwise they
+// are tried in order. If stream is set, the content is passed to it while it
+// is downloaded, and a source whose content it fails on is treated as failed.
+func downloadFromSources(filepath string, sources []string, strategy string, config httpClientConfig, stream downloadStream) (downloadResult, error) {
+	if strategy != "race" || len(sources) == 1 {
+		var errs []string
+		for _, source := range sources {
+			contentType, err := downloadFile(context.Background(), filepath, source, config, stream)
+			if err == nil {
+				return downloadResult{source: source, contentType: contentType}, nil
+			}
+			if len(sources) > 1 {
+				showAttention(fmt.Sprintf("        > Mirror %s failed: %s", redactURL(source), err.Error()))
+			}
+			errs = append(errs, err.Error())
+		}
+		return downloadResult{}, errors.New(strings.Join(errs, "; "))
+	}
 
-	enabledLocalModules, err := ioutil.ReadDir(localModulesDir + "/enabled")
-	if err != nil {
-		return errors.New(fmt.Sprintf("    > Error: failed to read local modules directory: " + err.Error()))
+	type raceResult struct {
+		index       int
+		contentType string
+		err         error
 	}
 
-	if len(enabledLocalModules) == 0 {
-		showAttention("    > No module enabled")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan raceResult, len(sources))
+	for index, source := range sources {
+		go func(index int, source string) {
+			contentType, err := downloadFile(ctx, fmt.Sprintf("%s.%d", filepath, index), source, config, stream)
+			results <- raceResult{index: index, contentType: contentType, err: err}
+		}(index, source)
 	}
 
-	i := 0
-	for _, module := range enabledLocalModules {
-	if i >= 1 {
-		fmt.Println("")
+	winner := raceResult{index: -1}
+	var errs []string
+	for range sources {
+		result := <-results
+		if result.err != nil {
+			if winner.index == -1 {
+				errs = append(errs, result.err.Error())
+			}
+			continue
+		}
+		if winner.index == -1 {
+			// Stop the other downloads
+			winner = result
+			cancel()
+		}
 	}
 
-	orangeHex := "#ffa860"
-	orange := color.HEX(orangeHex)
+	for index := range sources {
+		if index != winner.index {
+			os.Remove(fmt.Sprintf("%s.%d", filepath, index))
+			os.Remove(fmt.Sprintf("%s.%d.content", filepath, index))
+		}
+	}
 
-	insertLine(tmphosts_file,"")
-	insertComment(tmphosts_file,fmt.Sprintf("Hosts from local module '%s'",module.Name()))
-	showInfo(fmt.Sprintf("    > Loading module %s",orange.Sprintf(module.Name())))
+	if winner.index == -1 {
+		return downloadResult{}, errors.New(strings.Join(errs, "; "))
+	}
 
-	file, err := os.Open(localModulesDir + "/enabled/" + module.Name())
+	err := os.Rename(fmt.Sprintf("%s.%d", filepath, winner.index), filepath)
 	if err != nil {
-		showError("        > Error: failed to open local module file: " + err.Error())
-		continue
+		return downloadResult{}, err
+	}
+	if stream != nil {
+		err = os.Rename(fmt.Sprintf("%s.%d.content", filepath, winner.index), filepath+".content")
+		if err != nil {
+			return downloadResult{}, err
+		}
 	}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "#") && line != "" {
-			parts := strings.Fields(line)
-			ipAddress := parts[0]
-			hostname := parts[1]
-			insertHost(tmphosts_file,ipAddress, hostname)
+	return downloadResult{source: sources[winner.index], contentType: winner.contentType}, nil
+}
+
+//
+//// INTEGRITY VERIFICATION
+//
+
+func verifySHA256(filePath string, expected string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if sum != expected {
+		return fmt.Errorf("SHA256 mismatch (expected %s, got %s)", expected, sum)
+	}
+
+	return nil
+}
+
+// Verifies the downloaded content of a web module against the checksum and
+// the detached signature set in the module file (if any)
+func verifyWebModuleContent(filePath string, moduleConfig webModuleConfig, httpConfig httpClientConfig) error {
+	if moduleConfig.sha256 != "" {
+		err := verifySHA256(filePath, moduleConfig.sha256)
+		if err != nil {
+			return err
 		}
+		showInfo("        > SHA256 verified")
 	}
 
-	file.Close()
-	insertLine(tmphosts_file,"")
+	if moduleConfig.signatureURL == "" {
+		return nil
+	}
 
-	showSuccess("        > Done")
-	i++
+	signatureFile := filePath + ".sig"
+	defer os.Remove(signatureFile)
+
+	httpConfig.maxSize = 1024 * 1024
+	_, err := downloadFile(context.Background(), signatureFile, moduleConfig.signatureURL, httpConfig, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %s", err.Error())
+	}
+
+	switch moduleConfig.signatureType {
+	case "openpgp":
+		err = verifyOpenPGPSignature(filePath, signatureFile, moduleConfig.publicKey)
+	default:
+		err = verifyMinisignSignature(filePath, signatureFile, moduleConfig.publicKey)
+	}
+	if err != nil {
+		return err
 	}
+	showInfo(fmt.Sprintf("        > %s signature verified", moduleConfig.signatureType))
 
 	return nil
 }
 
-func readWebModuleFile(filePath string) (string, error) {
-	bytes, err := ioutil.ReadFile(filePath)
+// The public key is either the key itself (as printed by 'minisign -G') or
+// the path to a minisign public key file
+func verifyMinisignSignature(filePath string, signatureFile string, publicKey string) error {
+	var key minisign.PublicKey
+	var err error
+	if _, statErr := os.Stat(publicKey); statErr == nil {
+		key, err = minisign.NewPublicKeyFromFile(publicKey)
+	} else {
+		key, err = minisign.NewPublicKey(publicKey)
+	}
 	if err != nil {
-		return "", err
+		return fmt.Errorf("invalid minisign public key: %s", err.Error())
+	}
+
+	signature, err := minisign.NewSignatureFromFile(signatureFile)
+	if err != nil {
+		return fmt.Errorf("invalid minisign signature: %s", err.Error())
+	}
+
+	valid, err := key.VerifyFromFile(filePath, signature)
+	if err != nil || !valid {
+		return errors.New("minisign signature verification failed")
 	}
-	return string(bytes), nil
+
+	return nil
 }
 
-func loadWebModules(tmphosts_file string, tmpDir string) error {
-	showInfoSectionTitle("Loading hosts from selected web sources")
-	time.Sleep(2 * time.Second)
+// The public key is the path to an OpenPGP public key (armored or binary). The
+// signature can be armored or binary as well.
+func verifyOpenPGPSignature(filePath string, signatureFile string, publicKey string) error {
+	keyData, err := ioutil.ReadFile(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to read OpenPGP public key: %s", err.Error())
+	}
 
-	enabledWebModules, err := ioutil.ReadDir(filepath.Join(programDir, "modules", "web", "enabled"))
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(keyData), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(keyData))
+	}
 	if err != nil {
-		return errors.New(fmt.Sprintf("    > Error reading enabled web modules: " + err.Error()))
+		return fmt.Errorf("invalid OpenPGP public key: %s", err.Error())
 	}
 
-	if len(enabledWebModules) == 0 {
-		showAttention("    > No module enabled")
+	signature, err := ioutil.ReadFile(signatureFile)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, content, bytes.NewReader(signature), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, content, bytes.NewReader(signature), nil)
+	}
+	if err != nil {
+		return fmt.Errorf("OpenPGP signature verification failed: %s", err.Error())
+	}
+
+	return nil
+}
+
+//
+//// DECOMPRESSION AND ARCHIVES
+//
+
+var compressionMagicNumbers = []struct {
+	compression string
+	magic       []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"bzip2", []byte("BZh")},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// Returns the extension of the path of a URL (or file), ignoring its query
+func getSourceExtension(source string) string {
+	if parsedURL, err := url.Parse(source); err == nil {
+		source = parsedURL.Path
+	}
+	return strings.ToLower(filepath.Ext(source))
+}
+
+// Detects the compression of a file from its first bytes, the extension of
+// its source or the Content-Type sent by the server (in this order)
+func detectCompression(header []byte, source string, contentType string) string {
+	for _, format := range compressionMagicNumbers {
+		if bytes.HasPrefix(header, format.magic) {
+			return format.compression
+		}
+	}
+
+	switch getSourceExtension(source) {
+	case ".gz", ".tgz":
+		return "gzip"
+	case ".bz2", ".tbz2":
+		return "bzip2"
+	case ".xz", ".txz":
+		return "xz"
+	case ".zst", ".tzst":
+		return "zstd"
+	}
+
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/gzip", "application/x-gzip":
+		return "gzip"
+	case "application/x-bzip2":
+		return "bzip2"
+	case "application/x-xz":
+		return "xz"
+	case "application/zstd":
+		return "zstd"
+	}
+
+	return "none"
+}
+
+// Detects if a (decompressed) file is a zip or tar archive
+func detectArchive(header []byte, source string, contentType string) string {
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")) {
+		return "zip"
+	}
+	if len(header) >= 262 && string(header[257:262]) == "ustar" {
+		return "tar"
+	}
+
+	sourcePath := strings.ToLower(source)
+	if parsedURL, err := url.Parse(source); err == nil {
+		sourcePath = strings.ToLower(parsedURL.Path)
+	}
+	for _, extension := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".tar.zst", ".tzst"} {
+		if strings.HasSuffix(sourcePath, extension) {
+			return "tar"
+		}
+	}
+
+	switch strings.TrimSpace(strings.Split(contentType, ";")[0]) {
+	case "application/zip":
+		return "zip"
+	case "application/x-tar":
+		return "tar"
+	}
+
+	return "none"
+}
+
+func newDecompressionReader(reader io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewReader(reader)
+	case "bzip2":
+		return ioutil.NopCloser(bzip2.NewReader(reader)), nil
+	case "xz":
+		xzReader, err := xz.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzReader), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(reader), nil
+	}
+}
+
+// Verifies if an archive member is one of the members selected in the module
+// file. Patterns are matched against the full path of the member and its base
+// name.
+func isSelectedArchiveMember(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, path.Base(name)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Fails once more than 'remaining' bytes are written, so that a small
+// compressed file can not be used to fill the disk
+type limitedWriter struct {
+	writer    io.Writer
+	remaining int64
+	// Called the first time the limit is exceeded, if set
+	onExceeded func()
+	exceeded   bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		if !w.exceeded && w.onExceeded != nil {
+			w.onExceeded()
+		}
+		w.exceeded = true
+		return 0, errors.New("content exceeds the maximum size")
+	}
+	w.remaining -= int64(len(p))
+	return w.writer.Write(p)
+}
+
+// Writes the plain text content of a downloaded (or cached) web module file to
+// contentFile
+func extractWebModuleContent(rawFile string, contentFile string, download downloadResult, moduleConfig webModuleConfig, maxSize int64) error {
+	in, err := os.Open(rawFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return extractWebModuleStream(in, contentFile, download, moduleConfig, maxSize)
+}
+
+// Writes the plain text content of a web module to contentFile, decompressing
+// it and extracting the selected members of archives as it is read, so that it
+// can be done while the module is downloaded. Zip archives are the exception:
+// they need random access, so they are first written to a temporary file
+// (unless they are read from an uncompressed file).
+func extractWebModuleStream(in io.Reader, contentFile string, download downloadResult, moduleConfig webModuleConfig, maxSize int64) error {
+	reader := bufio.NewReader(in)
+	header, _ := reader.Peek(512)
+
+	compression := moduleConfig.compression
+	if compression == "auto" {
+		compression = detectCompression(header, download.source, download.contentType)
+	}
+	if compression != "none" {
+		showInfo(fmt.Sprintf("        > Decompressing (%s)", compression))
+	}
+
+	decompressed, err := newDecompressionReader(reader, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	decompressedReader := bufio.NewReader(decompressed)
+	header, _ = decompressedReader.Peek(512)
+
+	out, err := os.Create(contentFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var writer io.Writer = out
+	if maxSize > 0 {
+		writer = &limitedWriter{writer: out, remaining: maxSize}
+	}
+
+	switch detectArchive(header, download.source, download.contentType) {
+	case "zip":
+		return extractZipMembers(in, decompressedReader, compression, contentFile, moduleConfig.archiveMembers, writer)
+	case "tar":
+		return extractTarMembers(tar.NewReader(decompressedReader), moduleConfig.archiveMembers, writer)
+	default:
+		_, err = io.Copy(writer, decompressedReader)
+		return err
+	}
+}
+
+// Zip archives need random access, so a zip archive that is compressed, or
+// not read from a file, is first written to a temporary file
+func extractZipMembers(in io.Reader, decompressed io.Reader, compression string, contentFile string, patterns []string, writer io.Writer) error {
+	archiveFile, isFile := in.(*os.File)
+	if compression != "none" || !isFile {
+		tmpArchive, err := os.Create(contentFile + ".zip")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpArchive.Name())
+		defer tmpArchive.Close()
+
+		_, err = io.Copy(tmpArchive, decompressed)
+		if err != nil {
+			return err
+		}
+		archiveFile = tmpArchive
+	}
+
+	info, err := archiveFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	archive, err := zip.NewReader(archiveFile, info.Size())
+	if err != nil {
+		return err
+	}
+
+	var members []*zip.File
+	for _, member := range archive.File {
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		if len(patterns) == 0 || isSelectedArchiveMember(member.Name, patterns) {
+			members = append(members, member)
+		}
+	}
+
+	if len(members) == 0 {
+		return errors.New("no matching member found in zip archive")
+	}
+	if len(patterns) == 0 && len(members) > 1 {
+		return fmt.Errorf("zip archive contains %d files, set ARCHIVE_MEMBER in the module to select them", len(members))
+	}
+
+	for _, member := range members {
+		showInfo(fmt.Sprintf("        > Extracting %s", member.Name))
+		memberReader, err := member.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, memberReader)
+		memberReader.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(writer)
+	}
+
+	return nil
+}
+
+func extractTarMembers(archive *tar.Reader, patterns []string, writer io.Writer) error {
+	extracted := 0
+	for {
+		member, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if member.Typeflag != tar.TypeReg {
+			continue
+		}
+		if len(patterns) > 0 && !isSelectedArchiveMember(member.Name, patterns) {
+			continue
+		}
+		if len(patterns) == 0 && extracted == 1 {
+			return errors.New("tar archive contains more than one file, set ARCHIVE_MEMBER in the module to select them")
+		}
+
+		showInfo(fmt.Sprintf("        > Extracting %s", member.Name))
+		_, err = io.Copy(writer, archive)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(writer)
+		extracted++
+	}
+
+	if extracted == 0 {
+		return errors.New("no matching member found in tar archive")
+	}
+
+	return nil
+}
+
+//
+//// WEB MODULE CACHE
+//
+
+// Each web module gets its own directory inside the cache directory, holding
+// the last downloaded copy of the list ('hosts') and a 'metadata' file that
+// follows the same KEY=VALUE format as the preferences file.
+
+func getWebModuleCacheDir(moduleName string) string {
+	return filepath.Join(webCacheDir, moduleName)
+}
+
+func getWebModuleCacheFile(moduleName string) string {
+	return filepath.Join(getWebModuleCacheDir(moduleName), "hosts")
+}
+
+func readWebModuleCacheMetadata(moduleName string) map[string]string {
+	metadata := map[string]string{}
+
+	file, err := os.Open(filepath.Join(getWebModuleCacheDir(moduleName), "metadata"))
+	if err != nil {
+		return metadata
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			metadata[parts[0]] = parts[1]
+		}
+	}
+
+	return metadata
+}
+
+func writeWebModuleCacheMetadata(moduleName string, metadata map[string]string) error {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var content strings.Builder
+	for _, key := range keys {
+		content.WriteString(key + "=" + metadata[key] + "\n")
+	}
+
+	// The mode is only applied to new files, so the one of older (world
+	// readable) metadata files is fixed as well
+	metadataFile := filepath.Join(getWebModuleCacheDir(moduleName), "metadata")
+	err := ioutil.WriteFile(metadataFile, []byte(content.String()), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(metadataFile, 0600)
+}
+
+// Returns a hash of the module settings that decide what the cached copy of a
+// web module holds (its sources, how it was verified and how its content is
+// extracted), so that the copy is not reused once they are edited. The cached
+// copy is only stored once verified, so a matching key also means that it was
+// verified with the current checksum, signature and public key.
+func getWebModuleCacheKey(moduleConfig webModuleConfig) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "URL=%s\n", moduleConfig.url)
+	for _, mirror := range moduleConfig.mirrors {
+		fmt.Fprintf(hash, "MIRROR=%s\n", mirror)
+	}
+	fmt.Fprintf(hash, "SHA256=%s\n", moduleConfig.sha256)
+	fmt.Fprintf(hash, "SIGNATURE_URL=%s\n", moduleConfig.signatureURL)
+	fmt.Fprintf(hash, "SIGNATURE_TYPE=%s\n", moduleConfig.signatureType)
+	fmt.Fprintf(hash, "PUBLIC_KEY=%s\n", moduleConfig.publicKey)
+	if moduleConfig.signatureURL != "" {
+		// A public key file can be replaced without editing the module
+		if key, err := ioutil.ReadFile(moduleConfig.publicKey); err == nil {
+			hash.Write(key)
+		}
+	}
+	fmt.Fprintf(hash, "COMPRESSION=%s\n", moduleConfig.compression)
+	for _, member := range moduleConfig.archiveMembers {
+		fmt.Fprintf(hash, "ARCHIVE_MEMBER=%s\n", member)
+	}
+	fmt.Fprintf(hash, "FORMAT=%s\n", moduleConfig.format)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Returns the time the cached copy of a web module was last fetched. The
+// second value is false if there is no usable cached copy, which includes a
+// copy fetched with other settings than the ones the module now has.
+func getWebModuleLastFetched(moduleName string, moduleConfig webModuleConfig) (time.Time, bool) {
+	if _, err := os.Stat(getWebModuleCacheFile(moduleName)); err != nil {
+		return time.Time{}, false
+	}
+
+	metadata := readWebModuleCacheMetadata(moduleName)
+	if metadata["KEY"] != getWebModuleCacheKey(moduleConfig) {
+		return time.Time{}, false
+	}
+
+	fetched, err := time.Parse(time.RFC3339, metadata["FETCHED"])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return fetched, true
+}
+
+func storeWebModuleCache(moduleName string, moduleConfig webModuleConfig, downloadedFile string, download downloadResult) error {
+	err := os.MkdirAll(getWebModuleCacheDir(moduleName), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = copyFile(downloadedFile, getWebModuleCacheFile(moduleName))
+	if err != nil {
+		return err
+	}
+
+	metadata := readWebModuleCacheMetadata(moduleName)
+	metadata["FETCHED"] = time.Now().Format(time.RFC3339)
+	metadata["KEY"] = getWebModuleCacheKey(moduleConfig)
+	metadata["SOURCE"] = redactURL(download.source)
+	metadata["CONTENT_TYPE"] = download.contentType
+
+	return writeWebModuleCacheMetadata(moduleName, metadata)
+}
+
+//
+//// HOSTS ENTRIES
+//
+
+// An address and the hostnames mapped to it, as found in a module
+type hostsEntry struct {
+	address   string
+	hostnames []string
+	comment   string
+	// Line of the module the entry was read from
+	line int
+	// Whether the entry blocks its hostnames (sends them to a sinkhole
+	// address) instead of mapping them to a real address
+	blocking bool
+	// Other modules that contained each hostname (for the same address
+	// family) and whose entries were dropped as duplicates, shown by the
+	// verbose summary
+	alsoIn map[string][]string
+	// Whether the entry is the IPv6 twin of an IPv4 blocking entry
+	twin bool
+}
+
+// The entries loaded from a module
+type moduleResult struct {
+	kind    string
+	name    string
+	entries []hostsEntry
+	// Exception rules of the module, such as '@@||example.com^' in Adblock
+	// lists, applied with the allowlist rules
+	exceptions []allowRule
+	// Number of lines that could not be used, by reason
+	skipped map[string]int
+	// Number of hostnames dropped because an earlier module already
+	// contained them, by that module
+	duplicates map[string]int
+	// Number of lines written to the hosts file (entries grouped by
+	// HOSTNAMES_PER_LINE share a line)
+	written int
+	// 'allow' for web modules publishing allowlists, whose hostnames are
+	// turned into allowlist rules instead of being written
+	role string
+	// Number of IPv6 twin entries added
+	twins int
+	// Number of bytes the IPv6 twin entries take in the hosts file, as
+	// written (after compaction)
+	twinsSize int
+}
+
+func getModuleLabel(result moduleResult) string {
+	return fmt.Sprintf("%s module '%s'", result.kind, result.name)
+}
+
+// Addresses used by blocklists to make blocked hostnames unreachable
+var sinkholeAddresses = []string{"0.0.0.0", "127.0.0.1", "::", "::1"}
+
+func isSinkholeAddress(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, sinkhole := range sinkholeAddresses {
+		if ip.Equal(net.ParseIP(sinkhole)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Names that lists map to the loopback addresses on purpose and that must
+// never be redirected or blocked
+var localhostNames = []string{"localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0"}
+
+func isLocalhostName(hostname string) bool {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	for _, name := range localhostNames {
+		if hostname == name {
+			return true
+		}
+	}
+	return strings.HasSuffix(hostname, ".localhost")
+}
+
+func newHostsEntry(address string, hostnames []string, comment string, line int) hostsEntry {
+	entry := hostsEntry{address: address, hostnames: hostnames, comment: comment, line: line}
+
+	entry.blocking = isSinkholeAddress(address)
+	for _, hostname := range hostnames {
+		if isLocalhostName(hostname) {
+			entry.blocking = false
+		}
+	}
+
+	return entry
+}
+
+func formatHostsEntry(entry hostsEntry) string {
+	line := entry.address + " " + strings.Join(entry.hostnames, " ")
+	if entry.comment != "" {
+		line += " # " + entry.comment
+	}
+	return line
+}
+
+// Normalizes a hostname (lowercase, no trailing dot, Unicode names converted
+// to punycode) and verifies that it follows the RFC 1123 rules, so that the
+// resolver does not silently ignore or misparse it
+func normalizeHostname(hostname string) (string, error) {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+
+	for _, character := range hostname {
+		if character > unicode.MaxASCII {
+			ascii, err := idna.Lookup.ToASCII(hostname)
+			if err != nil {
+				return "", fmt.Errorf("invalid internationalized hostname '%s': %s", hostname, err.Error())
+			}
+			hostname = ascii
+			break
+		}
+	}
+
+	if hostname == "" {
+		return "", errors.New("empty hostname")
+	}
+	if len(hostname) > 253 {
+		return "", fmt.Errorf("hostname '%s' is longer than 253 characters", hostname)
+	}
+
+	labels := strings.Split(hostname, ".")
+	for _, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("hostname '%s' has an empty label", hostname)
+		}
+		if len(label) > 63 {
+			return "", fmt.Errorf("label '%s' of hostname '%s' is longer than 63 characters", label, hostname)
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("label '%s' of hostname '%s' starts or ends with a hyphen", label, hostname)
+		}
+		for _, character := range label {
+			if !(character >= 'a' && character <= 'z') && !(character >= '0' && character <= '9') && character != '-' {
+				return "", fmt.Errorf("hostname '%s' contains invalid character '%c'", hostname, character)
+			}
+		}
+	}
+
+	// The top-level label can not be all-numeric, so that hostnames can not
+	// be confused with addresses
+	if _, err := strconv.Atoi(labels[len(labels)-1]); err == nil {
+		return "", fmt.Errorf("hostname '%s' looks like an address", hostname)
+	}
+
+	return hostname, nil
+}
+
+// Number of lines shown for each kind of problem found in a module, the
+// others being only counted
+const maxReportedProblems = 5
+
+// Problems of one kind found in the lines of a module. Lists can have
+// thousands of bad lines, so only a count and a few examples are shown.
+type problemReport struct {
+	count    int
+	examples []string
+}
+
+func (report *problemReport) add(line int, message string) {
+	report.count++
+	if len(report.examples) < maxReportedProblems {
+		report.examples = append(report.examples, fmt.Sprintf("line %d: %s", line, message))
+	}
+}
+
+func (report *problemReport) show(summary string) {
+	if report.count == 0 {
+		return
+	}
+
+	showAttention("        > " + summary)
+	for _, example := range report.examples {
+		showAttention("            > " + example)
+	}
+	if report.count > len(report.examples) {
+		showAttention(fmt.Sprintf("            > and %d more", report.count-len(report.examples)))
+	}
+}
+
+// Validates the addresses and normalizes the hostnames of the entries of a
+// module. Entries with an invalid address are removed, and so are invalid
+// hostnames (the rest of their entry is kept). Problems are summarized like
+// the rejections of the sanitizer; 'invalid address' counts the removed
+// entries and 'invalid hostname' the removed hostnames.
+func validateModuleEntries(result *moduleResult) {
+	if result.skipped == nil {
+		result.skipped = map[string]int{}
+	}
+
+	var invalidAddresses, invalidHostnames problemReport
+	var entries []hostsEntry
+	for _, entry := range result.entries {
+		if _, err := netip.ParseAddr(entry.address); err != nil {
+			invalidAddresses.add(entry.line, fmt.Sprintf("invalid address '%s'", entry.address))
+			result.skipped["invalid address"]++
+			continue
+		}
+
+		var hostnames []string
+		for _, hostname := range entry.hostnames {
+			normalized, err := normalizeHostname(hostname)
+			if err != nil {
+				invalidHostnames.add(entry.line, err.Error())
+				result.skipped["invalid hostname"]++
+				continue
+			}
+			hostnames = append(hostnames, normalized)
+		}
+		if len(hostnames) == 0 {
+			continue
+		}
+
+		entry.hostnames = hostnames
+		entries = append(entries, entry)
+	}
+	result.entries = entries
+
+	var exceptions []allowRule
+	for _, rule := range result.exceptions {
+		normalized, err := normalizeHostname(rule.pattern)
+		if err != nil {
+			invalidHostnames.add(rule.line, err.Error())
+			result.skipped["invalid hostname"]++
+			continue
+		}
+		rule.pattern = normalized
+		exceptions = append(exceptions, rule)
+	}
+	result.exceptions = exceptions
+
+	invalidAddresses.show(fmt.Sprintf("Removed %d entries with an invalid address", invalidAddresses.count))
+	invalidHostnames.show(fmt.Sprintf("Removed %d invalid hostnames", invalidHostnames.count))
+}
+
+// Parses the content of a web or exec module according to its format
+func parseModuleContent(filePath string, format string) (moduleResult, error) {
+	result := moduleResult{skipped: map[string]int{}}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+
+	var zone rpzZoneState
+	lineNumber := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if lineNumber == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+
+		switch format {
+		case "adblock":
+			parseAdblockLine(line, lineNumber, &result)
+		case "domains":
+			parseDomainsLine(line, lineNumber, &result)
+		case "dnsmasq":
+			parseDnsmasqLine(line, lineNumber, &result)
+		case "unbound":
+			parseUnboundLine(line, lineNumber, &result)
+		case "rpz":
+			parseRPZLine(line, lineNumber, &result, &zone)
+		default:
+			parseHostsLine(line, lineNumber, &result)
+		}
+	}
+
+	return result, scanner.Err()
+}
+
+// Formats a web module list can be written in
+var moduleFormats = []string{"hosts", "domains", "adblock", "dnsmasq", "unbound", "rpz"}
+
+func isModuleFormat(format string) bool {
+	for _, moduleFormat := range moduleFormats {
+		if format == moduleFormat {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of non-comment lines looked at to detect the format of a list
+const formatDetectionLines = 50
+
+// Detects the format of a list from its first non-comment lines. Each line is
+// matched against the syntax of every format, and the format matching most
+// lines is chosen. Detection fails if no format matches at least half of the
+// lines or if two formats match the same number of lines.
+func detectModuleFormat(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	matches := map[string]int{}
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() && lines < formatDetectionLines {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		lines++
+		for _, format := range moduleFormats {
+			if matchesModuleFormat(line, format) {
+				matches[format]++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if lines == 0 {
+		// Nothing to load whatever the format is
+		return "hosts", nil
+	}
+
+	best := ""
+	ambiguous := false
+	for _, format := range moduleFormats {
+		if matches[format] > matches[best] {
+			best = format
+			ambiguous = false
+		} else if best != "" && matches[format] == matches[best] {
+			ambiguous = true
+		}
+	}
+
+	if best == "" || matches[best]*2 < lines {
+		return "", errors.New("the format of the list could not be detected, set FORMAT in the module file")
+	}
+	if ambiguous {
+		return "", errors.New("the format of the list is ambiguous, set FORMAT in the module file")
+	}
+
+	return best, nil
+}
+
+// Verifies if a non-comment line looks like a line of the given format
+func matchesModuleFormat(line string, format string) bool {
+	fields := strings.Fields(line)
+
+	switch format {
+	case "hosts":
+		return len(fields) >= 2 && net.ParseIP(fields[0]) != nil
+	case "domains":
+		return len(fields) == 1 && strings.Contains(line, ".") && net.ParseIP(line) == nil && !strings.ContainsAny(line, "|^$/=:@*\"")
+	case "adblock":
+		return strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.Contains(line, "##")
+	case "dnsmasq":
+		return strings.HasPrefix(line, "address=/") || strings.HasPrefix(line, "server=/") || strings.HasPrefix(line, "local=/")
+	case "unbound":
+		return strings.HasPrefix(line, "local-zone:") || strings.HasPrefix(line, "local-data:")
+	case "rpz":
+		if strings.HasPrefix(line, "$TTL") || strings.HasPrefix(line, "$ORIGIN") {
+			return true
+		}
+		for _, field := range fields[1:] {
+			switch strings.ToUpper(field) {
+			case "CNAME", "SOA", "NS":
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Parses a line of a list with one domain to block per line
+func parseDomainsLine(line string, lineNumber int, result *moduleResult) {
+	if index := strings.Index(line, "#"); index >= 0 {
+		line = line[:index]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+	if len(fields) > 1 || net.ParseIP(fields[0]) != nil {
+		result.skipped["invalid"]++
+		return
+	}
+
+	result.entries = append(result.entries, newHostsEntry("0.0.0.0", []string{strings.ToLower(fields[0])}, "", lineNumber))
+}
+
+// Parses a line of a dnsmasq configuration. 'address=/domain/IP' maps the
+// domains to the address, with no address (or '#') meaning they are blocked;
+// 'server=/domain/' and 'local=/domain/' without an upstream server block the
+// domains too. Forwarding to other servers can not be expressed in a hosts file.
+func parseDnsmasqLine(line string, lineNumber int, result *moduleResult) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+
+	option, value, found := strings.Cut(line, "=")
+	if !found || !strings.HasPrefix(value, "/") {
+		result.skipped["unsupported"]++
+		return
+	}
+
+	parts := strings.Split(value[1:], "/")
+	target := parts[len(parts)-1]
+	domains := parts[:len(parts)-1]
+	if len(domains) == 0 {
+		result.skipped["invalid"]++
+		return
+	}
+
+	address := "0.0.0.0"
+	switch option {
+	case "address":
+		if target != "" && target != "#" {
+			if net.ParseIP(target) == nil {
+				result.skipped["invalid"]++
+				return
+			}
+			address = target
+		}
+	case "server", "local":
+		if target != "" {
+			result.skipped["unsupported"]++
+			return
+		}
+	default:
+		result.skipped["unsupported"]++
+		return
+	}
+
+	var hostnames []string
+	for _, domain := range domains {
+		if domain == "" || domain == "#" || strings.Contains(domain, "*") {
+			result.skipped["wildcard"]++
+			return
+		}
+		hostnames = append(hostnames, strings.ToLower(domain))
+	}
+
+	result.entries = append(result.entries, newHostsEntry(address, hostnames, "", lineNumber))
+}
+
+// Zone types of unbound's 'local-zone' that make a domain unreachable
+var unboundBlockingZoneTypes = map[string]bool{"static": true, "refuse": true, "deny": true, "redirect": true, "always_refuse": true, "always_nxdomain": true, "always_null": true, "always_deny": true, "inform_deny": true}
+
+// Parses a line of an unbound configuration. Blocking 'local-zone' lines
+// become blocking entries and 'local-data' A and AAAA records are mapped to
+// their address.
+func parseUnboundLine(line string, lineNumber int, result *moduleResult) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || line == "server:" {
+		return
+	}
+
+	option, value, found := strings.Cut(line, ":")
+	if !found {
+		result.skipped["invalid"]++
+		return
+	}
+	fields := strings.Fields(strings.ReplaceAll(value, "\"", " "))
+
+	switch option {
+	case "local-zone":
+		if len(fields) != 2 {
+			result.skipped["invalid"]++
+			return
+		}
+		if !unboundBlockingZoneTypes[fields[1]] {
+			result.skipped["unsupported"]++
+			return
+		}
+		result.entries = append(result.entries, newHostsEntry("0.0.0.0", []string{strings.ToLower(strings.TrimSuffix(fields[0], "."))}, "", lineNumber))
+	case "local-data":
+		// name [TTL] [class] type rdata
+		if len(fields) < 3 {
+			result.skipped["invalid"]++
+			return
+		}
+		recordType := strings.ToUpper(fields[len(fields)-2])
+		if recordType != "A" && recordType != "AAAA" {
+			result.skipped["unsupported"]++
+			return
+		}
+		address := fields[len(fields)-1]
+		if net.ParseIP(address) == nil {
+			result.skipped["invalid"]++
+			return
+		}
+		result.entries = append(result.entries, newHostsEntry(address, []string{strings.ToLower(strings.TrimSuffix(fields[0], "."))}, "", lineNumber))
+	default:
+		result.skipped["unsupported"]++
+	}
+}
+
+// State kept while parsing a zone file
+type rpzZoneState struct {
+	origin string
+	// Whether the parser is inside a record spanning several lines
+	inParentheses bool
+}
+
+// Parses a line of a BIND response policy zone. 'CNAME .' (NXDOMAIN) and
+// 'CNAME *.' (NODATA) records become blocking entries, 'CNAME rpz-passthru.'
+// records exact exception rules, and A and AAAA records are mapped to their
+// address.
+func parseRPZLine(line string, lineNumber int, result *moduleResult, zone *rpzZoneState) {
+	if index := strings.Index(line, ";"); index >= 0 {
+		line = line[:index]
+	}
+
+	if zone.inParentheses {
+		if strings.Contains(line, ")") {
+			zone.inParentheses = false
+		}
+		return
+	}
+	if strings.Contains(line, "(") && !strings.Contains(line, ")") {
+		zone.inParentheses = true
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	if fields[0] == "$ORIGIN" {
+		if len(fields) > 1 {
+			zone.origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		}
+		return
+	}
+	if strings.HasPrefix(fields[0], "$") || fields[0] == "@" || unicode.IsSpace(rune(line[0])) {
+		// Directives, records of the zone itself and records owned by the
+		// previous name (SOA, NS and the like)
+		return
+	}
+
+	name := strings.ToLower(fields[0])
+	if strings.HasSuffix(name, ".") {
+		name = strings.TrimSuffix(name, ".")
+		if zone.origin != "" {
+			name = strings.TrimSuffix(name, "."+zone.origin)
+		}
+	}
+
+	// name [TTL] [class] type rdata
+	recordType := ""
+	rdata := ""
+	for index, field := range fields[1:] {
+		upper := strings.ToUpper(field)
+		if _, err := strconv.Atoi(field); err == nil || upper == "IN" {
+			continue
+		}
+		recordType = upper
+		if index+2 < len(fields) {
+			rdata = strings.ToLower(fields[index+2])
+		}
+		break
+	}
+
+	if strings.HasPrefix(name, "*.") {
+		result.skipped["wildcard"]++
+		return
+	}
+
+	switch recordType {
+	case "CNAME":
+		switch rdata {
+		case ".", "*.":
+			result.entries = append(result.entries, newHostsEntry("0.0.0.0", []string{name}, "", lineNumber))
+		case "rpz-passthru.":
+			result.exceptions = append(result.exceptions, allowRule{text: name, kind: "exact", pattern: name, line: lineNumber})
+		default:
+			result.skipped["unsupported"]++
+		}
+	case "A", "AAAA":
+		if net.ParseIP(rdata) == nil {
+			result.skipped["invalid"]++
+			return
+		}
+		result.entries = append(result.entries, newHostsEntry(rdata, []string{name}, "", lineNumber))
+	case "SOA", "NS":
+	default:
+		result.skipped["unsupported"]++
+	}
+}
+
+func parseHostsLine(line string, lineNumber int, result *moduleResult) {
+	entry, found, err := parseHostsEntry(line, lineNumber)
+	if err != nil {
+		result.skipped["invalid"]++
+	} else if found {
+		result.entries = append(result.entries, entry)
+	}
+}
+
+// Parses a line in the /etc/hosts syntax: an address followed by one or more
+// hostnames (the canonical name and its aliases), separated by spaces or tabs,
+// and optionally followed by a comment. Returns false for blank and comment
+// lines. The byte order mark of the first line and the carriage return of
+// lines ending with CRLF are ignored.
+func parseHostsEntry(line string, lineNumber int) (hostsEntry, bool, error) {
+	line = strings.TrimSuffix(line, "\r")
+	if lineNumber == 1 {
+		line = strings.TrimPrefix(line, "\ufeff")
+	}
+
+	comment := ""
+	if index := strings.Index(line, "#"); index >= 0 {
+		comment = strings.TrimSpace(line[index+1:])
+		line = line[:index]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return hostsEntry{}, false, nil
+	}
+	if len(fields) < 2 {
+		return hostsEntry{}, false, fmt.Errorf("expected an address followed by at least one hostname, got '%s'", strings.TrimSpace(line))
+	}
+
+	return newHostsEntry(fields[0], fields[1:], comment, lineNumber), true, nil
+}
+
+// Modifiers that do not restrict the requests a rule applies to, so that the
+// rule can still be expressed in a hosts file
+var adblockNeutralModifiers = map[string]bool{"important": true, "all": true}
+
+// Parses a line in Adblock/uBlock filter syntax. Only rules blocking (or, for
+// exceptions, allowing) whole domains are kept: '||example.com^' becomes a
+// blocking entry and '@@||example.com^' an exception rule for the domain and
+// its subdomains. Lines in hosts
+// syntax, which some of these lists include, are kept as well.
+func parseAdblockLine(line string, lineNumber int, result *moduleResult) {
+	rule := strings.TrimSpace(line)
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") {
+		return
+	}
+
+	for _, separator := range []string{"##", "#@#", "#?#", "#$#", "#%#"} {
+		if strings.Contains(rule, separator) {
+			result.skipped["cosmetic"]++
+			return
+		}
+	}
+	if strings.HasPrefix(rule, "#") {
+		return
+	}
+
+	if fields := strings.Fields(rule); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		parseHostsLine(rule, lineNumber, result)
+		return
+	}
+
+	exception := strings.HasPrefix(rule, "@@")
+	rule = strings.TrimPrefix(rule, "@@")
+
+	if index := strings.LastIndex(rule, "$"); index >= 0 {
+		for _, modifier := range strings.Split(rule[index+1:], ",") {
+			if !adblockNeutralModifiers[strings.TrimSpace(modifier)] {
+				result.skipped["unsupported"]++
+				return
+			}
+		}
+		rule = rule[:index]
+	}
+
+	if strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") && len(rule) > 1 {
+		// Regular expression
+		result.skipped["unsupported"]++
+		return
+	}
+
+	if strings.HasPrefix(rule, "||") {
+		rule = strings.TrimSuffix(strings.TrimSuffix(rule[2:], "|"), "^")
+	}
+
+	if strings.Contains(rule, "*") {
+		result.skipped["wildcard"]++
+		return
+	}
+	if strings.ContainsAny(rule, "/^|:?=&,") || !strings.Contains(rule, ".") {
+		result.skipped["unsupported"]++
+		return
+	}
+
+	domain := strings.ToLower(rule)
+	if exception {
+		result.exceptions = append(result.exceptions, allowRule{text: "@@||" + domain + "^", kind: "domain", pattern: domain, line: lineNumber})
+	} else {
+		result.entries = append(result.entries, newHostsEntry("0.0.0.0", []string{domain}, "", lineNumber))
+	}
+}
+
+func showSkippedRules(result moduleResult) {
+	var reasons []string
+	total := 0
+	for _, reason := range []string{"invalid", "wildcard", "cosmetic", "unsupported"} {
+		if result.skipped[reason] > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d %s", result.skipped[reason], reason))
+			total += result.skipped[reason]
+		}
+	}
+
+	if total > 0 {
+		showAttention(fmt.Sprintf("        > Skipped %d lines that can not be expressed in a hosts file (%s)", total, strings.Join(reasons, ", ")))
+	}
+	if len(result.exceptions) > 0 {
+		showInfo(fmt.Sprintf("        > %d exception rules will be applied with the allowlist", len(result.exceptions)))
+	}
+}
+
+// The addresses blocked hostnames are sent to, for each address family. An
+// empty address keeps the one used by the list.
+type blockAddresses struct {
+	ipv4 string
+	ipv6 string
+}
+
+// Reads the addresses blocked hostnames are sent to (BLOCK_ADDRESS for IPv4
+// entries, BLOCK_ADDRESS_IPV6 for IPv6 entries)
+func getBlockAddresses() (blockAddresses, error) {
+	addresses := blockAddresses{
+		ipv4: getOptionalConfigValue("BLOCK_ADDRESS", "0.0.0.0"),
+		ipv6: getOptionalConfigValue("BLOCK_ADDRESS_IPV6", "::"),
+	}
+
+	if addresses.ipv4 != "" && !isIPv4Address(addresses.ipv4) {
+		return addresses, fmt.Errorf("BLOCK_ADDRESS: invalid IPv4 address '%s'", addresses.ipv4)
+	}
+	if addresses.ipv6 != "" {
+		ip, err := netip.ParseAddr(addresses.ipv6)
+		if err != nil || !ip.Is6() || ip.Is4In6() {
+			return addresses, fmt.Errorf("BLOCK_ADDRESS_IPV6: invalid IPv6 address '%s'", addresses.ipv6)
+		}
+	}
+	return addresses, nil
+}
+
+// Returns the block addresses of a web module: its REDIRECT_IP, if any,
+// replaces the preference of the same address family
+func getModuleBlockAddresses(addresses blockAddresses, redirectIP string) blockAddresses {
+	if redirectIP == "" {
+		return addresses
+	}
+	if isIPv4Address(redirectIP) {
+		addresses.ipv4 = redirectIP
+	} else {
+		addresses.ipv6 = redirectIP
+	}
+	return addresses
+}
+
+// Sends the blocking entries of a module to the block address of their
+// address family (if any)
+func redirectBlockingEntries(result *moduleResult, addresses blockAddresses) {
+	for index := range result.entries {
+		entry := &result.entries[index]
+		if !entry.blocking {
+			continue
+		}
+		if isIPv4Address(entry.address) && addresses.ipv4 != "" {
+			entry.address = addresses.ipv4
+		} else if !isIPv4Address(entry.address) && addresses.ipv6 != "" {
+			entry.address = addresses.ipv6
+		}
+	}
+}
+
+// Names of the machine the program runs on, which lists must not redirect
+func getOwnHostnames() []string {
+	var hostnames []string
+
+	kernelHostname := strings.TrimSuffix(strings.ToLower(getCurrentHostname()), ".")
+	hostname, fqdn := getHostnameAndFQDN()
+	hostname = strings.ToLower(hostname)
+	fqdn = strings.ToLower(fqdn)
+	candidates := []string{kernelHostname, hostname, fqdn}
+	for _, name := range []string{kernelHostname, hostname} {
+		if index := strings.Index(name, "."); index > 0 {
+			candidates = append(candidates, name[:index])
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate != "" && !containsString(hostnames, candidate) {
+			hostnames = append(hostnames, candidate)
+		}
+	}
+	return hostnames
+}
+
+// Tells why the sanitizer rejects a hostname of an entry, or returns an empty
+// string if the hostname is accepted
+func getRejectionReason(address string, hostname string, ownHostnames []string) string {
+	if !isSinkholeAddress(address) {
+		return fmt.Sprintf("%s is mapped to %s, which is not a sinkhole address", hostname, address)
+	}
+	if isLocalhostName(hostname) {
+		return fmt.Sprintf("%s is a localhost name", hostname)
+	}
+	for _, ownHostname := range ownHostnames {
+		if strings.TrimSuffix(strings.ToLower(hostname), ".") == ownHostname {
+			return fmt.Sprintf("%s is the name of this machine", hostname)
+		}
+	}
+	return ""
+}
+
+// Ways the sanitizer reports rejected entries: every one of them with its
+// line, or only their number and the first few of them
+var sanitizerReports = []string{"all", "summary"}
+
+func getSanitizerReport() (string, error) {
+	report := getConfigValueOrDefault("SANITIZER_REPORT", "all")
+	if !containsString(sanitizerReports, report) {
+		return "", fmt.Errorf("expected one of %s, got '%s'", strings.Join(sanitizerReports, ", "), report)
+	}
+	return report, nil
+}
+
+// Removes the hostnames of a module that could be used to hijack them:
+// hostnames mapped to anything other than a sinkhole address, localhost-class
+// names and the machine's own hostname. The other hostnames of their entry are
+// kept. Each rejected hostname is reported with its line, unless only a
+// summary is asked for.
+func sanitizeModuleEntries(result *moduleResult, ownHostnames []string, report string) {
+	var rejected problemReport
+	var entries []hostsEntry
+	for _, entry := range result.entries {
+		var hostnames []string
+		for _, hostname := range entry.hostnames {
+			reason := getRejectionReason(entry.address, hostname, ownHostnames)
+			if reason != "" {
+				if report == "all" {
+					showAttention(fmt.Sprintf("        > Rejected line %d of module '%s': %s", entry.line, result.name, reason))
+				}
+				rejected.add(entry.line, reason)
+				result.skipped["rejected"]++
+				continue
+			}
+			hostnames = append(hostnames, hostname)
+		}
+		if len(hostnames) > 0 {
+			entry.hostnames = hostnames
+			entries = append(entries, entry)
+		}
+	}
+	result.entries = entries
+
+	summary := fmt.Sprintf("Rejected %d hostnames (set TRUSTED=true in the module file to keep them)", rejected.count)
+	if report == "summary" {
+		rejected.show(summary)
+	} else if rejected.count > 0 {
+		showAttention("        > " + summary)
+	}
+}
+
+// Key identifying a hostname for an address family, as a hostname can be
+// mapped to both an IPv4 and an IPv6 address
+func getHostnameKey(hostname string, address string) string {
+	if isIPv4Address(address) {
+		return hostname + "/ipv4"
+	}
+	return hostname + "/ipv6"
+}
+
+// Verifies if an address is an IPv4 address (including IPv4-mapped IPv6
+// addresses, which the resolver handles as IPv4)
+func isIPv4Address(address string) bool {
+	ip, err := netip.ParseAddr(address)
+	return err == nil && ip.Unmap().Is4()
+}
+
+// A hostname mapped to different addresses by different entries
+type hostnameConflict struct {
+	hostname string
+	kept     conflictSide
+	dropped  conflictSide
+}
+
+type conflictSide struct {
+	module  string
+	kind    string
+	address string
+	line    int
+}
+
+// Policies resolving conflicts between entries mapping the same hostname to
+// different addresses
+var conflictPolicies = []string{"first", "local-over-web", "error"}
+
+func getConflictPolicy() (string, error) {
+	policy := getConfigValueOrDefault("CONFLICT_POLICY", "first")
+	if !containsString(conflictPolicies, policy) {
+		return "", fmt.Errorf("expected one of %s, got '%s'", strings.Join(conflictPolicies, ", "), policy)
+	}
+	return policy, nil
+}
+
+// Verifies if two entries for the same hostname and address family conflict.
+// Two blocking entries never do, even if their lists use different sinkhole
+// addresses.
+func isConflictingEntry(first hostsEntry, second hostsEntry) bool {
+	if first.blocking && second.blocking {
+		return false
+	}
+	firstIP, errFirst := netip.ParseAddr(first.address)
+	secondIP, errSecond := netip.ParseAddr(second.address)
+	if errFirst != nil || errSecond != nil {
+		return first.address != second.address
+	}
+	return firstIP.Unmap() != secondIP.Unmap()
+}
+
+// Kinds of modules, in the default order their entries are merged in
+var moduleKinds = []string{"local", "web", "exec"}
+
+// Reads the order in which the entries of each kind of module are merged
+// (MODULE_ORDER, a comma separated list of every kind). Earlier modules win
+// duplicates and, with the 'first' policy, conflicts.
+func getModuleOrder() ([]string, error) {
+	value := getConfigValueOrDefault("MODULE_ORDER", strings.Join(moduleKinds, ","))
+
+	var order []string
+	for _, kind := range strings.Split(value, ",") {
+		kind = strings.TrimSpace(kind)
+		if !containsString(moduleKinds, kind) || containsString(order, kind) {
+			return nil, fmt.Errorf("expected each of %s once, got '%s'", strings.Join(moduleKinds, ", "), value)
+		}
+		order = append(order, kind)
+	}
+	if len(order) != len(moduleKinds) {
+		return nil, fmt.Errorf("expected each of %s once, got '%s'", strings.Join(moduleKinds, ", "), value)
+	}
+	return order, nil
+}
+
+// Puts the results of the modules in the given order of kinds, keeping the
+// order of the modules of each kind
+func orderModuleResults(results []moduleResult, order []string) []moduleResult {
+	var ordered []moduleResult
+	for _, kind := range order {
+		for _, result := range results {
+			if result.kind == kind {
+				ordered = append(ordered, result)
+			}
+		}
+	}
+	return ordered
+}
+
+// Removes the hostnames already contained in an earlier module (or earlier in
+// the same module) for the same address family. The first occurrence is kept
+// and records the modules whose duplicates were dropped.
+//
+// Entries mapping a hostname to different addresses conflict, and so do a
+// blocking entry and a mapping to a real address in the other address family
+// (a local module pointing a hostname to an IPv4 address while a list blocks
+// it with '::'). Conflicts are resolved according to the policy ('first' keeps
+// the entry of the module merged first, 'local-over-web' makes entries of
+// local modules win over the ones of web and exec modules whatever the module
+// order), counted as skipped by the losing module, and returned.
+func deduplicateModules(results []moduleResult, policy string) []hostnameConflict {
+	type entryPosition struct {
+		result int
+		entry  int
+	}
+	owners := map[string]entryPosition{}
+	var conflicts []hostnameConflict
+
+	for resultIndex := range results {
+		results[resultIndex].duplicates = map[string]int{}
+		if results[resultIndex].skipped == nil {
+			results[resultIndex].skipped = map[string]int{}
+		}
+	}
+
+	// Records a conflict between the entry owning a hostname and a later
+	// entry, and returns whether the later entry wins. When it does, the
+	// hostname is removed from the owner.
+	resolveConflict := func(owner entryPosition, current entryPosition, hostname string) bool {
+		ownerResult := &results[owner.result]
+		ownerEntry := &ownerResult.entries[owner.entry]
+		result := &results[current.result]
+		entry := &result.entries[current.entry]
+
+		conflict := hostnameConflict{
+			hostname: hostname,
+			kept:     conflictSide{module: getModuleLabel(*ownerResult), kind: ownerResult.kind, address: ownerEntry.address, line: ownerEntry.line},
+			dropped:  conflictSide{module: getModuleLabel(*result), kind: result.kind, address: entry.address, line: entry.line},
+		}
+
+		currentWins := policy == "local-over-web" && result.kind == "local" && ownerResult.kind != "local"
+		if !currentWins {
+			result.skipped["conflict"]++
+			conflicts = append(conflicts, conflict)
+			return false
+		}
+
+		conflict.kept, conflict.dropped = conflict.dropped, conflict.kept
+		conflicts = append(conflicts, conflict)
+
+		var ownerHostnames []string
+		for _, ownerHostname := range ownerEntry.hostnames {
+			if ownerHostname != hostname {
+				ownerHostnames = append(ownerHostnames, ownerHostname)
+			}
+		}
+		ownerEntry.hostnames = ownerHostnames
+		ownerResult.skipped["conflict"]++
+		return true
+	}
+
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		label := getModuleLabel(*result)
+
+		for entryIndex := range result.entries {
+			entry := &result.entries[entryIndex]
+			current := entryPosition{result: resultIndex, entry: entryIndex}
+
+			var hostnames []string
+			for _, hostname := range entry.hostnames {
+				key := getHostnameKey(hostname, entry.address)
+				otherKey := hostname + "/ipv4"
+				if isIPv4Address(entry.address) {
+					otherKey = hostname + "/ipv6"
+				}
+
+				if owner, found := owners[key]; found {
+					ownerEntry := &results[owner.result].entries[owner.entry]
+					if !isConflictingEntry(*ownerEntry, *entry) {
+						ownerLabel := getModuleLabel(results[owner.result])
+						result.duplicates[ownerLabel]++
+						if owner.result != resultIndex && !containsString(ownerEntry.alsoIn[hostname], label) {
+							if ownerEntry.alsoIn == nil {
+								ownerEntry.alsoIn = map[string][]string{}
+							}
+							ownerEntry.alsoIn[hostname] = append(ownerEntry.alsoIn[hostname], label)
+						}
+						continue
+					}
+					if !resolveConflict(owner, current, hostname) {
+						continue
+					}
+				}
+
+				if owner, found := owners[otherKey]; found && results[owner.result].entries[owner.entry].blocking != entry.blocking {
+					if !resolveConflict(owner, current, hostname) {
+						continue
+					}
+					delete(owners, otherKey)
+				}
+
+				owners[key] = current
+				hostnames = append(hostnames, hostname)
+			}
+			entry.hostnames = hostnames
+		}
+	}
+
+	// Drop the entries left without hostnames
+	for resultIndex := range results {
+		var entries []hostsEntry
+		for _, entry := range results[resultIndex].entries {
+			if len(entry.hostnames) > 0 {
+				entries = append(entries, entry)
+			}
+		}
+		results[resultIndex].entries = entries
+	}
+
+	return conflicts
+}
+
+// Merges the entries of modules (in MODULE_ORDER) as the update does. The
+// allowlist is applied first, so that an allowlisted hostname is neither a
+// duplicate nor part of a conflict: otherwise, it could make the entry of
+// another module lose a conflict, and then be removed itself.
+func mergeModuleResults(results []moduleResult, rules []allowRule, policy string) []hostnameConflict {
+	applyAllowlist(results, rules)
+	return deduplicateModules(results, policy)
+}
+
+func showConflicts(conflicts []hostnameConflict, policy string) {
+	showInfoSectionTitle("Conflicts")
+
+	if len(conflicts) == 0 {
+		showSuccess("    > No conflict found")
+		return
+	}
+
+	for _, conflict := range conflicts {
+		kept := fmt.Sprintf("%s (%s, line %d)", conflict.kept.address, conflict.kept.module, conflict.kept.line)
+		dropped := fmt.Sprintf("%s (%s, line %d)", conflict.dropped.address, conflict.dropped.module, conflict.dropped.line)
+		if policy == "error" {
+			showError(fmt.Sprintf("    > %s: %s conflicts with %s", conflict.hostname, kept, dropped))
+		} else {
+			showAttention(fmt.Sprintf("    > %s: kept %s, dropped %s", conflict.hostname, kept, dropped))
+		}
+	}
+}
+
+// Reads the IPv6 address twin entries of blocked hostnames point to, or an
+// empty string if twin entries are disabled
+func getIPv6TwinAddress() (string, error) {
+	enabled, err := strconv.ParseBool(getConfigValueOrDefault("IPV6_TWIN_ENTRIES", "false"))
+	if err != nil {
+		return "", fmt.Errorf("IPV6_TWIN_ENTRIES: %s", err.Error())
+	}
+	if !enabled {
+		return "", nil
+	}
+
+	address := getConfigValueOrDefault("BLOCK_ADDRESS_IPV6", "::")
+	ip, err := netip.ParseAddr(address)
+	if err != nil || !ip.Is6() || ip.Is4In6() {
+		return "", fmt.Errorf("BLOCK_ADDRESS_IPV6: invalid IPv6 address '%s'", address)
+	}
+	return address, nil
+}
+
+// Adds, after every IPv4 blocking entry of web and exec modules, an entry
+// sending the same hostnames to an IPv6 address, so that applications
+// resolving AAAA records do not reach blocked hosts. Hostnames that already
+// have an IPv6 entry in any module are left out.
+func addIPv6TwinEntries(results []moduleResult, address string) {
+	ipv6Hostnames := map[string]bool{}
+	for _, result := range results {
+		for _, entry := range result.entries {
+			if isIPv4Address(entry.address) {
+				continue
+			}
+			for _, hostname := range entry.hostnames {
+				ipv6Hostnames[hostname] = true
+			}
+		}
+	}
+
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		if result.kind == "local" {
+			continue
+		}
+
+		var entries []hostsEntry
+		for _, entry := range result.entries {
+			entries = append(entries, entry)
+			if !entry.blocking || !isIPv4Address(entry.address) {
+				continue
+			}
+
+			var hostnames []string
+			for _, hostname := range entry.hostnames {
+				if !ipv6Hostnames[hostname] {
+					ipv6Hostnames[hostname] = true
+					hostnames = append(hostnames, hostname)
+				}
+			}
+			if len(hostnames) == 0 {
+				continue
+			}
+
+			twin := hostsEntry{address: address, hostnames: hostnames, line: entry.line, blocking: true, twin: true}
+			entries = append(entries, twin)
+			result.twins++
+		}
+		result.entries = entries
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Number of rules listed for each module in the summary
+const maxSummaryRules = 10
+
+// Shows, for every module, how many entries were written and how many were
+// dropped as duplicates or skipped, the size of the IPv6 twin entries, and how
+// many hostnames each allowlist rule removed
+func showRunSummary(results []moduleResult, rules []allowRule, verbose bool) {
+	showInfoSectionTitle("Summary")
+
+	if len(results) == 0 {
+		showAttention("    > No module loaded")
+		return
+	}
+
+	orangeHex := "#ffa860"
+	orange := color.HEX(orangeHex)
+
+	for _, result := range results {
+		duplicates := 0
+		var owners []string
+		for owner, count := range result.duplicates {
+			duplicates += count
+			owners = append(owners, fmt.Sprintf("%d already in %s", count, owner))
+		}
+		sort.Strings(owners)
+
+		skipped := 0
+		for _, count := range result.skipped {
+			skipped += count
+		}
+
+		twins := ""
+		if result.twins > 0 {
+			twins = fmt.Sprintf(" (%d IPv6 twins)", result.twins)
+		}
+
+		showInfo(fmt.Sprintf("    > %s module %s: %d lines written%s, %d duplicates, %d skipped", result.kind, orange.Sprintf(result.name), result.written, twins, duplicates, skipped))
+		for _, owner := range owners {
+			showInfo("        > " + owner)
+		}
+
+		if verbose {
+			for _, entry := range result.entries {
+				for _, hostname := range entry.hostnames {
+					if modules := entry.alsoIn[hostname]; len(modules) > 0 {
+						showInfo(fmt.Sprintf("        > %s (line %d) is also in %s", hostname, entry.line, strings.Join(modules, ", ")))
+					}
+				}
+			}
+		}
+	}
+
+	totalTwins := 0
+	twinsSize := 0
+	for _, result := range results {
+		totalTwins += result.twins
+		twinsSize += result.twinsSize
+	}
+	if totalTwins > 0 {
+		showInfo(fmt.Sprintf("    > IPv6 twin entries: %d added, %.1f KiB more in the hosts file", totalTwins, float64(twinsSize)/1024))
+	}
+
+	// Rules of modules are grouped by module, which can have thousands of
+	// them; only the rules that removed the most hostnames are listed
+	moduleRules := map[string][]allowRule{}
+	var modules []string
+	for _, rule := range rules {
+		if rule.module != "" {
+			if _, found := moduleRules[rule.file]; !found {
+				modules = append(modules, rule.file)
+			}
+			moduleRules[rule.file] = append(moduleRules[rule.file], rule)
+			continue
+		}
+		showInfo(fmt.Sprintf("    > Allowlist rule %s (%s:%d): %d hostnames removed", orange.Sprintf(rule.text), rule.file, rule.line, rule.removed))
+	}
+	for _, module := range modules {
+		removed := 0
+		var matching []allowRule
+		for _, rule := range moduleRules[module] {
+			removed += rule.removed
+			if rule.removed > 0 {
+				matching = append(matching, rule)
+			}
+		}
+		sort.SliceStable(matching, func(i, j int) bool {
+			return matching[i].removed > matching[j].removed
+		})
+
+		showInfo(fmt.Sprintf("    > Allowlist and exception rules of %s: %d hostnames removed", module, removed))
+		for index, rule := range matching {
+			if index == maxSummaryRules {
+				showInfo(fmt.Sprintf("        > and %d more rules", len(matching)-maxSummaryRules))
+				break
+			}
+			showInfo(fmt.Sprintf("        > %s (line %d): %d hostnames removed", orange.Sprintf(rule.text), rule.line, rule.removed))
+		}
+	}
+}
+
+// Groups the entries sharing the same address into lines of up to
+// hostnamesPerLine hostnames, which makes large hosts files smaller and faster
+// to parse. Lines are ordered by the first appearance of their address;
+// entries with a comment are kept on their own line so the comment stays with
+// its hostnames, and IPv6 twin entries are never grouped with entries of the
+// list.
+func compactEntries(entries []hostsEntry, hostnamesPerLine int) []hostsEntry {
+	type lineKey struct {
+		address string
+		twin    bool
+	}
+
+	var compacted []hostsEntry
+	// Position of the line being filled for each address
+	openLines := map[lineKey]int{}
+
+	for _, entry := range entries {
+		if entry.comment != "" {
+			compacted = append(compacted, entry)
+			continue
+		}
+
+		for _, hostname := range entry.hostnames {
+			key := lineKey{address: entry.address, twin: entry.twin}
+			index, found := openLines[key]
+			if !found || len(compacted[index].hostnames) >= hostnamesPerLine {
+				compacted = append(compacted, hostsEntry{address: entry.address, line: entry.line, blocking: entry.blocking, twin: entry.twin})
+				index = len(compacted) - 1
+				openLines[key] = index
+			}
+			compacted[index].hostnames = append(compacted[index].hostnames, hostname)
+		}
+	}
+
+	return compacted
+}
+
+// Resolvers limit the number of aliases of a hosts file line (MAXALIASES, 35
+// in glibc) and may ignore the hostnames past it, so lines are never made
+// longer than that
+const maxHostnamesPerLine = 35
+
+func getHostnamesPerLine() (int, error) {
+	hostnamesPerLine, err := strconv.Atoi(getConfigValueOrDefault("HOSTNAMES_PER_LINE", "1"))
+	if err != nil || hostnamesPerLine < 1 || hostnamesPerLine > maxHostnamesPerLine {
+		return 0, fmt.Errorf("expected a number between 1 and %d", maxHostnamesPerLine)
+	}
+	return hostnamesPerLine, nil
+}
+
+// Writes the entries of all modules to the temporary hosts file
+func writeModules(tmphosts_file string, results []moduleResult) error {
+	showInfoSectionTitle("Writing hosts to the temporary hosts file")
+
+	hostnamesPerLine, err := getHostnamesPerLine()
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: invalid HOSTNAMES_PER_LINE option in preferences file: " + err.Error()))
+	}
+	stripComments, err := strconv.ParseBool(getConfigValueOrDefault("STRIP_WEB_COMMENTS", "false"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: invalid STRIP_WEB_COMMENTS option in preferences file: " + err.Error()))
+	}
+
+	file, err := os.OpenFile(tmphosts_file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: failed to open file: " + err.Error()))
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	written := 0
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		fmt.Fprintln(writer, "")
+		fmt.Fprintln(writer, fmt.Sprintf("# Hosts from %s module '%s'", result.kind, result.name))
+
+		var entries []hostsEntry
+		for _, entry := range result.entries {
+			if stripComments && result.kind != "local" {
+				entry.comment = ""
+			}
+			entries = append(entries, entry)
+		}
+
+		// Entries of local modules are written as they are
+		if hostnamesPerLine > 1 && result.kind != "local" {
+			entries = compactEntries(entries, hostnamesPerLine)
+		}
+		for _, entry := range entries {
+			line := formatHostsEntry(entry)
+			fmt.Fprintln(writer, line)
+			result.written++
+			written++
+			if entry.twin {
+				result.twinsSize += len(line) + 1
+			}
+		}
+
+		fmt.Fprintln(writer, "")
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: failed to write to file: " + err.Error()))
+	}
+
+	showSuccess(fmt.Sprintf("    > %d lines written", written))
+	return nil
+}
+
+//
+//// ALLOWLIST
+//
+
+// A rule of an allowlist file: an exact hostname, a wildcard ('*.example.com',
+// matching the subdomains of example.com) or a regular expression written
+// between slashes ('/^ads?[0-9]*\.example\.com$/'). Exception rules of
+// Adblock lists ('@@||example.com^') are 'domain' rules, matching a domain and
+// its subdomains.
+type allowRule struct {
+	text    string
+	kind    string
+	pattern string
+	regexp  *regexp.Regexp
+	file    string
+	line    int
+	// Web module the rule comes from, for allowlists published on the web
+	module  string
+	// Number of hostnames the rule removed during the update
+	removed int
+}
+
+func parseAllowRule(text string) (allowRule, error) {
+	rule := allowRule{text: text}
+
+	if len(text) > 2 && strings.HasPrefix(text, "/") && strings.HasSuffix(text, "/") {
+		expression, err := regexp.Compile(text[1 : len(text)-1])
+		if err != nil {
+			return rule, fmt.Errorf("invalid regular expression '%s': %s", text, err.Error())
+		}
+		rule.kind = "regex"
+		rule.regexp = expression
+		return rule, nil
+	}
+
+	rule.kind = "exact"
+	hostname := text
+	if strings.HasPrefix(text, "*.") {
+		rule.kind = "wildcard"
+		hostname = text[2:]
+	}
+
+	normalized, err := normalizeHostname(hostname)
+	if err != nil {
+		return rule, err
+	}
+	rule.pattern = normalized
+	return rule, nil
+}
+
+func matchesAllowRule(rule allowRule, hostname string) bool {
+	switch rule.kind {
+	case "regex":
+		return rule.regexp.MatchString(hostname)
+	case "wildcard":
+		return strings.HasSuffix(hostname, "."+rule.pattern)
+	case "domain":
+		return hostname == rule.pattern || strings.HasSuffix(hostname, "."+rule.pattern)
+	default:
+		return hostname == rule.pattern
+	}
+}
+
+// Reads the rules of every allowlist file, in alphabetical order of the files
+func readAllowlistRules() ([]allowRule, error) {
+	var rules []allowRule
+
+	files, err := ioutil.ReadDir(allowlistDir)
+	if os.IsNotExist(err) {
+		return rules, nil
+	} else if err != nil {
+		return rules, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(allowlistDir, file.Name()))
+		if err != nil {
+			return rules, err
+		}
+
+		for index, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			rule, err := parseAllowRule(line)
+			if err != nil {
+				return rules, fmt.Errorf("%s, line %d: %s", file.Name(), index+1, err.Error())
+			}
+			rule.file = file.Name()
+			rule.line = index + 1
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+// Returns the allowlist rules of a module: its exception rules and, for an
+// allowlist web module, its hostnames (whatever their address) as exact rules
+func getModuleAllowRules(result moduleResult) []allowRule {
+	var rules []allowRule
+	label := getModuleLabel(result)
+
+	if result.role == "allow" {
+		for _, entry := range result.entries {
+			for _, hostname := range entry.hostnames {
+				rules = append(rules, allowRule{text: hostname, kind: "exact", pattern: hostname, file: label, line: entry.line, module: result.name})
+			}
+		}
+	}
+	for _, rule := range result.exceptions {
+		rule.file = label
+		rule.module = result.name
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// Removes the hostnames matched by an allowlist rule from the blocking entries
+// of web and exec modules. Entries of local modules are never affected. As it
+// runs before duplicates are removed, a hostname found in several modules is
+// only counted once for its rule (once per address family).
+func applyAllowlist(results []moduleResult, rules []allowRule) {
+	if len(rules) == 0 {
+		return
+	}
+
+	// Exact and domain rules, which web lists can have by the thousands, are
+	// looked up directly; the first rule for a hostname gets the credit
+	exactRules := map[string]int{}
+	domainRules := map[string]int{}
+	var patternRules []int
+	for index, rule := range rules {
+		switch rule.kind {
+		case "exact":
+			if _, found := exactRules[rule.pattern]; !found {
+				exactRules[rule.pattern] = index
+			}
+		case "domain":
+			if _, found := domainRules[rule.pattern]; !found {
+				domainRules[rule.pattern] = index
+			}
+		default:
+			patternRules = append(patternRules, index)
+		}
+	}
+
+	removed := map[string]bool{}
+	for resultIndex := range results {
+		result := &results[resultIndex]
+		if result.kind == "local" {
+			continue
+		}
+
+		var entries []hostsEntry
+		for _, entry := range result.entries {
+			if !entry.blocking {
+				entries = append(entries, entry)
+				continue
+			}
+
+			var hostnames []string
+			for _, hostname := range entry.hostnames {
+				ruleIndex, allowed := exactRules[hostname]
+				for domain := hostname; !allowed && domain != ""; {
+					ruleIndex, allowed = domainRules[domain]
+					_, domain, _ = strings.Cut(domain, ".")
+				}
+				if !allowed {
+					for _, index := range patternRules {
+						if matchesAllowRule(rules[index], hostname) {
+							ruleIndex = index
+							allowed = true
+							break
+						}
+					}
+				}
+				if allowed {
+					if key := getHostnameKey(hostname, entry.address); !removed[key] {
+						removed[key] = true
+						rules[ruleIndex].removed++
+					}
+				} else {
+					hostnames = append(hostnames, hostname)
+				}
+			}
+
+			if len(hostnames) == 0 {
+				continue
+			}
+			entry.hostnames = hostnames
+			entries = append(entries, entry)
+		}
+		result.entries = entries
+	}
+}
+
+func addAllowRule(text string, fileName string) error {
+	showInfo(fmt.Sprintf("Adding allowlist rule '%s'", text))
+
+	_, err := parseAllowRule(text)
+	if err != nil {
+		return fmt.Errorf("    > Invalid rule: %s", err.Error())
+	}
+	if fileName == "" || filepath.Base(fileName) != fileName || strings.HasPrefix(fileName, ".") {
+		return fmt.Errorf("    > Invalid allowlist file name '%s'", fileName)
+	}
+
+	rules, err := readAllowlistRules()
+	if err != nil {
+		return fmt.Errorf("    > Error reading allowlist files: %s", err.Error())
+	}
+	for _, rule := range rules {
+		if rule.text == text {
+			return fmt.Errorf("    > Already exists in %s", rule.file)
+		}
+	}
+
+	err = os.MkdirAll(allowlistDir, 0755)
+	if err != nil {
+		return fmt.Errorf("    > Error creating allowlist directory: %s", err.Error())
+	}
+
+	file, err := os.OpenFile(filepath.Join(allowlistDir, fileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("    > Error opening allowlist file: %s", err.Error())
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(text + "\n")
+	if err != nil {
+		return fmt.Errorf("    > Error writing to allowlist file: %s", err.Error())
+	}
+
+	showSuccess("    > Done")
+	return nil
+}
+
+func rmAllowRule(text string) error {
+	showInfo(fmt.Sprintf("Removing allowlist rule '%s'", text))
+
+	files, err := ioutil.ReadDir(allowlistDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("    > Error reading allowlist directory: %s", err.Error())
+	}
+
+	found := false
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filePath := filepath.Join(allowlistDir, file.Name())
+
+		content, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("    > Error reading allowlist file %s: %s", file.Name(), err.Error())
+		}
+
+		var lines []string
+		removed := false
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.TrimSpace(line) == text {
+				removed = true
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if !removed {
+			continue
+		}
+
+		err = ioutil.WriteFile(filePath, []byte(strings.Join(lines, "\n")), file.Mode())
+		if err != nil {
+			return fmt.Errorf("    > Error writing allowlist file %s: %s", file.Name(), err.Error())
+		}
+		showSuccess(fmt.Sprintf("    > Removed from %s", file.Name()))
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("    > Not found")
+	}
+	return nil
+}
+
+func listAllowRules() error {
+	showInfoSectionTitle("Listing allowlist rules")
+
+	rules, err := readAllowlistRules()
+	if err != nil {
+		return fmt.Errorf("    > Error reading allowlist files: %s", err.Error())
+	}
+
+	if len(rules) == 0 {
+		showAttention("    > No rule found")
+		return nil
+	}
+
+	blueHex := "#55aaff"
+	blue := color.HEX(blueHex)
+
+	for _, rule := range rules {
+		fmt.Println(fmt.Sprintf("%s %s", rule.text, blue.Sprintf("(%s, %s:%d)", rule.kind, rule.file, rule.line)))
+	}
+	return nil
+}
+
+func testAllowRules(hostname string) error {
+	showInfo(fmt.Sprintf("Testing hostname '%s'", hostname))
+
+	normalized, err := normalizeHostname(hostname)
+	if err != nil {
+		return fmt.Errorf("    > Invalid hostname: %s", err.Error())
+	}
+
+	rules, err := readAllowlistRules()
+	if err != nil {
+		return fmt.Errorf("    > Error reading allowlist files: %s", err.Error())
+	}
+
+	matched := false
+	for _, rule := range rules {
+		if matchesAllowRule(rule, normalized) {
+			showSuccess(fmt.Sprintf("    > Allowed by rule '%s' (%s:%d)", rule.text, rule.file, rule.line))
+			matched = true
+		}
+	}
+
+	if !matched {
+		showAttention("    > Not matched by any rule")
+	}
+	return nil
+}
+
+//
+//// LINT
+//
+
+// A problem found by the lint command. Errors make the command fail; warnings
+// point to lines that the update would drop or change, and to problems of web
+// lists, which the user can not fix.
+type lintIssue struct {
+	file     string
+	line     int
+	severity string
+	message  string
+}
+
+// Checks the addresses and hostnames of parsed entries, reporting invalid ones
+// with the given severity, and looks for hostnames listed more than once for
+// the same address (conflicting mappings are checked by lintConflicts).
+// Returns the issues and a copy of the entries with only their valid,
+// normalized hostnames, as the update would load them.
+func lintEntries(file string, entries []hostsEntry, severity string) ([]lintIssue, []hostsEntry) {
+	var issues []lintIssue
+	var valid []hostsEntry
+
+	seen := map[string]int{}
+
+	for _, entry := range entries {
+		ip, err := netip.ParseAddr(entry.address)
+		if err != nil {
+			issues = append(issues, lintIssue{file, entry.line, severity, fmt.Sprintf("invalid address '%s'", entry.address)})
+			continue
+		}
+
+		var hostnames []string
+		for _, hostname := range entry.hostnames {
+			normalized, err := normalizeHostname(hostname)
+			if err != nil {
+				issues = append(issues, lintIssue{file, entry.line, severity, err.Error()})
+				continue
+			}
+			hostnames = append(hostnames, normalized)
+
+			key := normalized + "/" + ip.Unmap().String()
+			if previousLine, found := seen[key]; found {
+				issues = append(issues, lintIssue{file, entry.line, "warning", fmt.Sprintf("duplicate entry for %s (already on line %d)", normalized, previousLine)})
+			} else {
+				seen[key] = entry.line
+			}
+		}
+
+		if len(hostnames) > 0 {
+			entry.hostnames = hostnames
+			valid = append(valid, entry)
+		}
+	}
+
+	return issues, valid
+}
+
+// Lints a file in the /etc/hosts syntax, such as a local module or the hosts
+// file itself. Invalid lines are reported with the given severity. Returns the
+// valid entries of the file as well.
+func lintHostsFile(filePath string, file string, severity string) ([]lintIssue, []hostsEntry, error) {
+	var issues []lintIssue
+	var entries []hostsEntry
+
+	in, err := os.Open(filePath)
+	if err != nil {
+		return issues, entries, err
+	}
+	defer in.Close()
+
+	lineNumber := 0
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNumber++
+		entry, found, err := parseHostsEntry(scanner.Text(), lineNumber)
+		if err != nil {
+			issues = append(issues, lintIssue{file, lineNumber, severity, err.Error() + " (the line would be dropped)"})
+		} else if found {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return issues, entries, err
+	}
+
+	entryIssues, entries := lintEntries(file, entries, severity)
+	return append(issues, entryIssues...), entries, nil
+}
+
+// Lints a web module: its module file and, if it was already downloaded, the
+// cached copy of its list (lint never downloads anything). Problems of the
+// module file are errors; problems of the list are warnings, as they are not
+// the user's to fix and the update skips the lines involved. Returns the
+// entries of the list the update would keep, for the conflict checks.
+func lintWebModule(moduleName string) ([]lintIssue, moduleResult) {
+	modulePath := filepath.Join(webModulesDir, "available", moduleName)
+	result := moduleResult{kind: "web", name: moduleName}
+
+	moduleConfig, err := readWebModuleFile(modulePath)
+	if err != nil {
+		return []lintIssue{{modulePath, 0, "error", err.Error()}}, result
+	}
+	result.role = moduleConfig.role
+
+	cacheFile := getWebModuleCacheFile(moduleName)
+	if _, err := os.Stat(cacheFile); err != nil {
+		showInfo("    > List not downloaded yet, only the module file was checked")
+		return nil, result
+	}
+
+	tmpDir, err := ioutil.TempDir("", "update-hosts-file-lint")
+	if err != nil {
+		return []lintIssue{{cacheFile, 0, "error", "failed to create temporary directory: " + err.Error()}}, result
+	}
+	defer os.RemoveAll(tmpDir)
+
+	maxSize := int64(100 * 1024 * 1024)
+	if httpConfig, err := getHTTPClientConfig(); err == nil {
+		maxSize = httpConfig.maxSize
+	}
+	if moduleConfig.maxSize > 0 {
+		maxSize = moduleConfig.maxSize
+	}
+
+	metadata := readWebModuleCacheMetadata(moduleName)
+	download := downloadResult{source: metadata["SOURCE"], contentType: metadata["CONTENT_TYPE"]}
+	contentFile := filepath.Join(tmpDir, moduleName+".content")
+	err = extractWebModuleContent(cacheFile, contentFile, download, moduleConfig, maxSize)
+	if err != nil {
+		return []lintIssue{{cacheFile, 0, "error", "failed to extract content: " + err.Error()}}, result
+	}
+
+	// Lines are reported against the list, as served by its source
+	file := fmt.Sprintf("%s (list of web module '%s')", redactURL(download.source), moduleName)
+	if download.source == "" {
+		file = fmt.Sprintf("list of web module '%s'", moduleName)
+	}
+
+	format := moduleConfig.format
+	if format == "auto" {
+		format, err = detectModuleFormat(contentFile)
+		if err != nil {
+			return []lintIssue{{modulePath, 0, "error", err.Error()}}, result
+		}
+	}
+
+	var issues []lintIssue
+	var entries []hostsEntry
+	if format == "hosts" {
+		issues, entries, err = lintHostsFile(contentFile, file, "warning")
+		if err != nil {
+			return append(issues, lintIssue{file, 0, "warning", err.Error()}), result
+		}
+	} else {
+		parsed, err := parseModuleContent(contentFile, format)
+		if err != nil {
+			return []lintIssue{{file, 0, "warning", err.Error()}}, result
+		}
+		issues, entries = lintEntries(file, parsed.entries, "warning")
+		result.exceptions = parsed.exceptions
+
+		for _, reason := range []string{"invalid", "wildcard", "cosmetic", "unsupported"} {
+			if parsed.skipped[reason] > 0 {
+				issues = append(issues, lintIssue{file, 0, "warning", fmt.Sprintf("%d %s lines would be dropped", parsed.skipped[reason], reason)})
+			}
+		}
+	}
+
+	if !moduleConfig.trusted && moduleConfig.role != "allow" {
+		ownHostnames := getOwnHostnames()
+		for _, entry := range entries {
+			var hostnames []string
+			for _, hostname := range entry.hostnames {
+				reason := getRejectionReason(entry.address, hostname, ownHostnames)
+				if reason != "" {
+					issues = append(issues, lintIssue{file, entry.line, "warning", "the hostname would be rejected by the sanitizer: " + reason})
+					continue
+				}
+				hostnames = append(hostnames, hostname)
+			}
+			if len(hostnames) > 0 {
+				entry.hostnames = hostnames
+				result.entries = append(result.entries, entry)
+			}
+		}
+	} else {
+		result.entries = entries
+	}
+
+	return issues, result
+}
+
+// Runs the conflict detection of the update on the entries of linted modules.
+// Conflicts are errors if the update would abort because of them, or if both
+// entries come from local modules (which the user has to fix); the update
+// resolves the other ones, so they are warnings.
+func lintConflicts(results []moduleResult, policy string) []lintIssue {
+	var issues []lintIssue
+
+	for _, conflict := range deduplicateModules(results, policy) {
+		kept := fmt.Sprintf("%s line %d", conflict.kept.module, conflict.kept.line)
+		if conflict.kept.module == conflict.dropped.module {
+			kept = fmt.Sprintf("line %d", conflict.kept.line)
+		}
+
+		severity := "warning"
+		outcome := "the update would keep " + kept
+		if policy == "error" {
+			severity = "error"
+			outcome = "the update would abort (CONFLICT_POLICY=error)"
+		} else if conflict.kept.kind == "local" && conflict.dropped.kind == "local" {
+			severity = "error"
+		}
+
+		issues = append(issues, lintIssue{conflict.dropped.module, conflict.dropped.line, severity, fmt.Sprintf("%s is mapped to %s, but %s maps it to %s; %s", conflict.hostname, conflict.dropped.address, kept, conflict.kept.address, outcome)})
+	}
+
+	return issues
+}
+
+// Checks every option of the preferences file, with the functions the update
+// reads them with
+func lintPreferences() []lintIssue {
+	file := filepath.Join(configDir, "preferences")
+	var issues []lintIssue
+	check := func(key string, err error) {
+		if err != nil {
+			message := err.Error()
+			if key != "" {
+				message = key + ": " + message
+			}
+			issues = append(issues, lintIssue{file, 0, "error", message})
+		}
+	}
+
+	_, err := getHTTPClientConfig()
+	check("", err)
+	_, err = getBlockAddresses()
+	check("", err)
+	_, err = getIPv6TwinAddress()
+	check("", err)
+	_, err = getConflictPolicy()
+	check("CONFLICT_POLICY", err)
+	_, err = getSanitizerReport()
+	check("SANITIZER_REPORT", err)
+	_, err = getModuleOrder()
+	check("MODULE_ORDER", err)
+	_, err = getHostnamesPerLine()
+	check("HOSTNAMES_PER_LINE", err)
+	_, err = strconv.ParseBool(getConfigValueOrDefault("STRIP_WEB_COMMENTS", "false"))
+	check("STRIP_WEB_COMMENTS", err)
+	_, err = parseInterval(getConfigValueOrDefault("EXEC_TIMEOUT", "30s"))
+	check("EXEC_TIMEOUT", err)
+	_, err = parseSize(getConfigValueOrDefault("EXEC_MAX_SIZE", "100M"))
+	check("EXEC_MAX_SIZE", err)
+	_, err = strconv.ParseBool(getConfigValueOrDefault("KEEP_ON_HOST_UNREACHABLE", "false"))
+	check("KEEP_ON_HOST_UNREACHABLE", err)
+	_, err = strconv.Atoi(getConfigValueOrDefault("MAX_BACKUP_FILES", "10"))
+	check("MAX_BACKUP_FILES", err)
+	_, err = getHostnameEntries()
+	check("", err)
+
+	return issues
+}
+
+func lintExecModule(moduleName string) []lintIssue {
+	modulePath := filepath.Join(execModulesDir, "available", moduleName)
+
+	_, err := readExecModuleFile(modulePath, 30*time.Second)
+	if err != nil {
+		return []lintIssue{{modulePath, 0, "error", err.Error()}}
+	}
+	return nil
+}
+
+// Lints the selected modules (all modules if none is selected) and hosts file,
+// and the preferences file when everything is linted. Conflicts between
+// enabled modules are looked for as the update would, in MODULE_ORDER; a
+// disabled module is only checked against itself. Returns the number of
+// errors found.
+func lint(localModule bool, webModule bool, execModule bool, moduleName string, hostsFile string) (int, error) {
+	type lintTarget struct {
+		kind string
+		name string
+	}
+	var targets []lintTarget
+
+	allModules := !localModule && !webModule && !execModule
+	if hostsFile == "" || moduleName != "" || !allModules {
+		for _, kind := range []string{"local", "web", "exec"} {
+			if !allModules && !(kind == "local" && localModule) && !(kind == "web" && webModule) && !(kind == "exec" && execModule) {
+				continue
+			}
+
+			modules, err := ioutil.ReadDir(filepath.Join(modulesDir, kind, "available"))
+			if err != nil && !os.IsNotExist(err) {
+				return 0, fmt.Errorf("    > Error: failed to read %s modules directory: %s", kind, err.Error())
+			}
+			for _, module := range modules {
+				if moduleName == "" || module.Name() == moduleName {
+					targets = append(targets, lintTarget{kind: kind, name: module.Name()})
+				}
+			}
+		}
+
+		if moduleName != "" && len(targets) == 0 {
+			return 0, fmt.Errorf("    > Error: module '%s' not found", moduleName)
+		}
+	}
+
+	orangeHex := "#ffa860"
+	orange := color.HEX(orangeHex)
+
+	errorCount := 0
+	warningCount := 0
+	report := func(issues []lintIssue) {
+		for _, issue := range issues {
+			location := issue.file
+			if issue.line > 0 {
+				location = fmt.Sprintf("%s:%d", issue.file, issue.line)
+			}
+			if issue.severity == "error" {
+				showError(fmt.Sprintf("    > %s: error: %s", location, issue.message))
+				errorCount++
+			} else {
+				showAttention(fmt.Sprintf("    > %s: warning: %s", location, issue.message))
+				warningCount++
+			}
+		}
+		if len(issues) == 0 {
+			showSuccess("    > No problem found")
+		}
+	}
+
+	// Invalid options are reported by lintPreferences
+	policy, err := getConflictPolicy()
+	if err != nil {
+		policy = "first"
+	}
+	order, err := getModuleOrder()
+	if err != nil {
+		order = moduleKinds
+	}
+
+	if allModules && moduleName == "" && hostsFile == "" {
+		showInfoSectionTitle("Linting preferences")
+		report(lintPreferences())
+		fmt.Println("")
+	}
+
+	var enabledResults []moduleResult
+	var moduleAllowRules []allowRule
+	for _, target := range targets {
+		showInfoSectionTitle(fmt.Sprintf("Linting %s module %s", target.kind, orange.Sprintf(target.name)))
+
+		var issues []lintIssue
+		result := moduleResult{kind: target.kind, name: target.name}
+		switch target.kind {
+		case "local":
+			modulePath := filepath.Join(localModulesDir, "available", target.name)
+			var err error
+			issues, result.entries, err = lintHostsFile(modulePath, modulePath, "error")
+			if err != nil {
+				issues = append(issues, lintIssue{modulePath, 0, "error", err.Error()})
+			}
+		case "web":
+			issues, result = lintWebModule(target.name)
+		case "exec":
+			issues = lintExecModule(target.name)
+		}
+
+		// The hostnames of allowlists are not written, so they can not
+		// conflict. Like in the update, the allowlists and exception rules of
+		// enabled modules apply to every enabled module.
+		if _, err := os.Stat(filepath.Join(modulesDir, target.kind, "enabled", target.name)); err == nil {
+			moduleAllowRules = append(moduleAllowRules, getModuleAllowRules(result)...)
+			if result.role != "allow" {
+				enabledResults = append(enabledResults, result)
+			}
+		} else if result.role != "allow" {
+			issues = append(issues, lintConflicts([]moduleResult{result}, policy)...)
+		}
+
+		report(issues)
+		fmt.Println("")
+	}
+
+	if len(enabledResults) > 0 {
+		showInfoSectionTitle("Linting conflicts between enabled modules")
+		allowRules, err := readAllowlistRules()
+		if err != nil {
+			report([]lintIssue{{allowlistDir, 0, "error", "failed to read allowlist files: " + err.Error()}})
+		}
+		enabledResults = orderModuleResults(enabledResults, order)
+		applyAllowlist(enabledResults, append(allowRules, moduleAllowRules...))
+		report(lintConflicts(enabledResults, policy))
+		fmt.Println("")
+	}
+
+	if hostsFile != "" {
+		showInfoSectionTitle(fmt.Sprintf("Linting hosts file %s", orange.Sprintf(hostsFile)))
+		issues, entries, err := lintHostsFile(hostsFile, hostsFile, "error")
+		if err != nil {
+			issues = append(issues, lintIssue{hostsFile, 0, "error", err.Error()})
+		}
+
+		// Every entry of the hosts file is the user's, like the ones of local
+		// modules
+		for _, issue := range lintConflicts([]moduleResult{{kind: "local", name: hostsFile, entries: entries}}, policy) {
+			issue.file = hostsFile
+			issues = append(issues, issue)
+		}
+		report(issues)
+		fmt.Println("")
+	}
+
+	if errorCount > 0 {
+		showError(fmt.Sprintf("%d errors, %d warnings", errorCount, warningCount))
+	} else {
+		showSuccess(fmt.Sprintf("%d errors, %d warnings", errorCount, warningCount))
+	}
+	return errorCount, nil
+}
+
+//
+//// FORMATTING
+//
+
+// Rewrites the content of a local module in a canonical form: the hostnames
+// of each entry are aligned in a column, duplicate entries (and hostnames
+// repeated on the same line) are removed, whitespace is normalized and, if
+// requested, entries are sorted by address then hostname. Hostnames are kept
+// as written; invalid ones are only returned as problems, with their line.
+// Hostnames are compared without case, and the comment of a removed duplicate
+// is added to the one of the entry kept. Comment and blank lines stay where
+// they are: entries are only sorted within the groups of lines they delimit.
+// Comment lines and lines that can not be parsed are kept as they are.
+func formatHostsContent(content string, sortEntries bool) (string, []string) {
+	content = strings.TrimPrefix(content, "\ufeff")
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+
+	type formattedLine struct {
+		text  string
+		entry *hostsEntry
+	}
+	var parsed []formattedLine
+	var problems []string
+
+	width := 0
+	seen := map[string]*hostsEntry{}
+	for index, line := range lines {
+		entry, found, err := parseHostsEntry(line, index+1)
+		if err != nil || !found {
+			if strings.TrimSpace(line) == "" {
+				line = ""
+			}
+			parsed = append(parsed, formattedLine{text: line})
+			continue
+		}
+
+		var hostnames []string
+		var keys []string
+		for _, hostname := range entry.hostnames {
+			if _, err := normalizeHostname(hostname); err != nil {
+				problems = append(problems, fmt.Sprintf("line %d: %s", entry.line, err.Error()))
+			}
+			key := strings.ToLower(hostname)
+			if !containsString(keys, key) {
+				keys = append(keys, key)
+				hostnames = append(hostnames, hostname)
+			}
+		}
+		entry.hostnames = hostnames
+
+		key := entry.address + " " + strings.Join(keys, " ")
+		if kept, found := seen[key]; found {
+			if entry.comment != "" && !containsString(strings.Split(kept.comment, "; "), entry.comment) {
+				if kept.comment != "" {
+					kept.comment += "; "
+				}
+				kept.comment += entry.comment
+			}
+			continue
+		}
+		seen[key] = &entry
+
+		if len(entry.address) > width {
+			width = len(entry.address)
+		}
+		parsed = append(parsed, formattedLine{entry: &entry})
+	}
+
+	var output []string
+	var group []*hostsEntry
+	flush := func() {
+		if sortEntries {
+			sort.SliceStable(group, func(i, j int) bool {
+				first, errFirst := netip.ParseAddr(group[i].address)
+				second, errSecond := netip.ParseAddr(group[j].address)
+				if errFirst == nil && errSecond == nil && first != second {
+					return first.Less(second)
+				}
+				if group[i].address != group[j].address {
+					return group[i].address < group[j].address
+				}
+				return strings.ToLower(group[i].hostnames[0]) < strings.ToLower(group[j].hostnames[0])
+			})
+		}
+		for _, entry := range group {
+			line := fmt.Sprintf("%-*s %s", width, entry.address, strings.Join(entry.hostnames, " "))
+			if entry.comment != "" {
+				line += " # " + entry.comment
+			}
+			output = append(output, line)
+		}
+		group = nil
+	}
+
+	for _, line := range parsed {
+		if line.entry != nil {
+			group = append(group, line.entry)
+			continue
+		}
+
+		flush()
+		// Consecutive blank lines are merged
+		if line.text == "" && (len(output) == 0 || output[len(output)-1] == "") {
+			continue
+		}
+		output = append(output, line.text)
+	}
+	flush()
+
+	for len(output) > 0 && output[len(output)-1] == "" {
+		output = output[:len(output)-1]
+	}
+	if len(output) == 0 {
+		return "", problems
+	}
+	return strings.Join(output, "\n") + "\n", problems
+}
+
+// Formats local modules (a single one or all of them). In check mode, files are
+// not modified and only the modules that would change are reported. Returns
+// the number of modules that were (or would be) changed.
+func fmtModules(moduleName string, allModules bool, sortEntries bool, check bool) (int, error) {
+	var modules []string
+	if allModules {
+		available, err := ioutil.ReadDir(filepath.Join(localModulesDir, "available"))
+		if err != nil {
+			return 0, fmt.Errorf("    > Error: failed to read local modules directory: %s", err.Error())
+		}
+		for _, module := range available {
+			modules = append(modules, module.Name())
+		}
+	} else {
+		modules = []string{moduleName}
+	}
+
+	changed := 0
+	for _, module := range modules {
+		showInfo(fmt.Sprintf("Formatting module '%s'", module))
+		modulePath := filepath.Join(localModulesDir, "available", module)
+
+		info, err := os.Stat(modulePath)
+		if err != nil {
+			return changed, fmt.Errorf("    > Not found")
+		}
+		content, err := ioutil.ReadFile(modulePath)
+		if err != nil {
+			return changed, fmt.Errorf("    > Error when trying to read module file: %s", err.Error())
+		}
+
+		formatted, problems := formatHostsContent(string(content), sortEntries)
+		for _, problem := range problems {
+			showAttention("    > Invalid hostname kept as is, " + problem)
+		}
+		if formatted == string(content) {
+			showSuccess("    > Already formatted")
+			continue
+		}
+		changed++
+
+		if check {
+			showAttention("    > Would be reformatted")
+			continue
+		}
+
+		err = ioutil.WriteFile(modulePath, []byte(formatted), info.Mode())
+		if err != nil {
+			return changed, fmt.Errorf("    > Error when trying to write module file: %s", err.Error())
+		}
+		showSuccess("    > Done")
+	}
+
+	return changed, nil
+}
+
+//
+//// MAIN FUNCTIONS
+//
+
+func insertHostname(tmphosts_file string) error {
+	showInfoSectionTitle("Inserting the hostname")
+
+	entries, err := getHostnameEntries()
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: " + err.Error()))
+	}
+
+	insertLine(tmphosts_file,"")
+	insertLine(tmphosts_file,"# Hostname")
+	for _, entry := range entries {
+		insertHost(tmphosts_file, entry.address, strings.Join(entry.hostnames, " "))
+		showInfo(fmt.Sprintf("    > %s", formatHostsEntry(entry)))
+	}
+	insertLine(tmphosts_file,"")
+	showSuccess("    > Done")
+	return nil
+}
+
+// Builds the entries of the hostname section from the preferences: the
+// hostname (and, if enabled, the fully qualified domain name) mapped to the
+// loopback address, to an IPv6 address and to the addresses of the selected
+// network interfaces
+func getHostnameEntries() ([]hostsEntry, error) {
+	var entries []hostsEntry
+
+	hostname, fqdn := getHostnameAndFQDN()
+	if hostname == "" {
+		return entries, errors.New("failed to get the hostname of the machine")
+	}
+
+	includeFQDN, err := strconv.ParseBool(getConfigValueOrDefault("HOSTNAME_FQDN", "false"))
+	if err != nil {
+		return entries, fmt.Errorf("invalid HOSTNAME_FQDN option in preferences file: %s", err.Error())
+	}
+	// The hostname is written as configured, even if it is a fully
+	// qualified name
+	hostnames := []string{hostname}
+	if includeFQDN && fqdn != "" {
+		// The canonical name goes first, the short name is an alias
+		shortName := hostname
+		if index := strings.Index(fqdn, "."); fqdn == hostname && index > 0 {
+			shortName = fqdn[:index]
+		}
+		hostnames = []string{fqdn}
+		if !strings.EqualFold(shortName, fqdn) {
+			hostnames = append(hostnames, shortName)
+		}
+	}
+
+	for _, key := range []string{"HOSTNAME_ADDRESS", "HOSTNAME_IPV6_ADDRESS"} {
+		// An empty HOSTNAME_IPV6_ADDRESS disables the IPv6 entry
+		address := getConfigValueOrDefault("HOSTNAME_ADDRESS", "127.0.0.1")
+		if key == "HOSTNAME_IPV6_ADDRESS" {
+			address = getOptionalConfigValue("HOSTNAME_IPV6_ADDRESS", "::1")
+		}
+		if address == "" {
+			continue
+		}
+		if net.ParseIP(address) == nil {
+			return entries, fmt.Errorf("invalid %s option in preferences file: invalid IP address '%s'", key, address)
+		}
+		entries = append(entries, hostsEntry{address: address, hostnames: hostnames})
+	}
+
+	interfaces := getConfigValueOrDefault("HOSTNAME_INTERFACES", "")
+	for _, name := range strings.Split(interfaces, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		addresses, err := getInterfaceAddresses(name)
+		if err != nil {
+			showAttention(fmt.Sprintf("    > Skipping interface %s: %s", name, err.Error()))
+			continue
+		}
+		for _, address := range addresses {
+			entries = append(entries, hostsEntry{address: address, hostnames: hostnames})
+		}
+	}
+
+	return entries, nil
+}
+
+// Returns the hostname of the machine, as configured, and, when it can be
+// determined, its fully qualified domain name. The name is read from
+// /etc/hostname (falling back to the kernel hostname); if it has no domain,
+// the domain is read from the HOSTNAME_DOMAIN preference or, if empty, from
+// the 'domain' or first 'search' setting of /etc/resolv.conf.
+func getHostnameAndFQDN() (string, string) {
+	hostname := ""
+	content, err := ioutil.ReadFile("/etc/hostname")
+	if err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				hostname = line
+				break
+			}
+		}
+	}
+	if hostname == "" {
+		hostname = getCurrentHostname()
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+
+	if strings.Index(hostname, ".") > 0 {
+		return hostname, hostname
+	}
+
+	domain := getConfigValueOrDefault("HOSTNAME_DOMAIN", "")
+	if domain == "" {
+		domain = getResolverDomain()
+	}
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return hostname, ""
+	}
+	return hostname, hostname + "." + domain
+}
+
+// Reads the local domain from /etc/resolv.conf: the 'domain' setting or, if
+// there is none, the first domain of the 'search' setting
+func getResolverDomain() string {
+	content, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+
+	search := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "domain":
+			return fields[1]
+		case "search":
+			if search == "" {
+				search = fields[1]
+			}
+		}
+	}
+	return search
+}
+
+// Returns the addresses of a network interface, except IPv6 link-local
+// addresses, which can not be used without a zone
+func getInterfaceAddresses(name string) ([]string, error) {
+	var addresses []string
+
+	networkInterface, err := net.InterfaceByName(name)
+	if err != nil {
+		return addresses, err
+	}
+	interfaceAddresses, err := networkInterface.Addrs()
+	if err != nil {
+		return addresses, err
+	}
+
+	for _, interfaceAddress := range interfaceAddresses {
+		ipNet, ok := interfaceAddress.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		addresses = append(addresses, ipNet.IP.String())
+	}
+
+	if len(addresses) == 0 {
+		return addresses, errors.New("no address assigned")
+	}
+	return addresses, nil
+}
+
+func restoreBackup(backupFile backup_file) {
+	fmt.Println("")
+	showAttention("An error has occurred. Backup will be restored.")
+
+	err := os.Rename(filepath.Join(backupDir, backupFile.filename), hostsFile)
+	if err != nil {
+		showError("    > Error: failed to restore backup: " + err.Error())
+		finishProgram(1)
+	}
+
+	showInfo("    > Hosts file restored.")
+	finishProgram(1)
+}
+
+
+func loadLocalModules() ([]moduleResult, error) {
+	showInfoSectionTitle("Loading local modules")
+	time.Sleep(2 * time.Second)
+
+	var results []moduleResult
+
+	enabledLocalModules, err := ioutil.ReadDir(localModulesDir + "/enabled")
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: failed to read local modules directory: " + err.Error()))
+	}
+
+	if len(enabledLocalModules) == 0 {
+		showAttention("    > No module enabled")
+	}
+
+	i := 0
+	for _, module := range enabledLocalModules {
+	if i >= 1 {
+		fmt.Println("")
+	}
+
+	orangeHex := "#ffa860"
+	orange := color.HEX(orangeHex)
+
+	showInfo(fmt.Sprintf("    > Loading module %s",orange.Sprintf(module.Name())))
+
+	file, err := os.Open(localModulesDir + "/enabled/" + module.Name())
+	if err != nil {
+		showError("        > Error: failed to open local module file: " + err.Error())
+		continue
+	}
+
+	result := moduleResult{kind: "local", name: module.Name(), skipped: map[string]int{}}
+	lineNumber := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNumber++
+		entry, found, err := parseHostsEntry(scanner.Text(), lineNumber)
+		if err != nil {
+			showAttention(fmt.Sprintf("        > Invalid line %d of local module '%s': %s", lineNumber, module.Name(), err.Error()))
+			result.skipped["invalid"]++
+		} else if found {
+			result.entries = append(result.entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		showAttention(fmt.Sprintf("        > Error reading local module '%s' after line %d: %s", module.Name(), lineNumber, err.Error()))
+	}
+
+	file.Close()
+	validateModuleEntries(&result)
+	results = append(results, result)
+
+	showSuccess(fmt.Sprintf("        > Done (%d entries)", len(result.entries)))
+	i++
+	}
+
+	return results, nil
+}
+
+type webModuleConfig struct {
+	description     string
+	homepage        string
+	license         string
+	format          string
+	role            string
+	redirectIP      string
+	failurePolicy   string
+	url             string
+	mirrors         []string
+	mirrorStrategy  string
+	refreshInterval time.Duration
+	maxSize         int64
+	proxy           string
+	caBundle        string
+	clientCert      string
+	clientKey       string
+	headers         []webModuleHeader
+	sha256          string
+	signatureURL    string
+	signatureType   string
+	publicKey       string
+	allowHTTP       bool
+	compression     string
+	archiveMembers  []string
+	trusted         bool
+}
+
+// A header sent when downloading a web module. Secret values are not stored in
+// the module file: 'file' points to the file the value is read from.
+type webModuleHeader struct {
+	name   string
+	value  string
+	file   string
+	base64 bool
+}
+
+// A web module file is either a bare URL (the original format) or a manifest
+// made of KEY=VALUE lines, following the same format as the preferences file:
+//
+//   DESCRIPTION=Unified hosts file with base extensions
+//   HOMEPAGE=https://github.com/StevenBlack/hosts
+//   LICENSE=MIT
+//   URL=https://example.com/hosts
+//   MIRROR=https://mirror.example.com/hosts
+//   REFRESH_INTERVAL=12h
+//   FAILURE_POLICY=skip
+//
+// All supported keys are documented in the README.
+func readWebModuleFile(filePath string) (webModuleConfig, error) {
+	config := webModuleConfig{}
+
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return config, err
+	}
+
+	for _, line := range strings.Split(string(bytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found || !isModuleKey(key) {
+			// Plain URL file (any following URL is a mirror)
+			if config.url == "" {
+				config.url = line
+			} else {
+				config.mirrors = append(config.mirrors, line)
+			}
+			continue
+		}
+
+		switch key {
+		case "DESCRIPTION":
+			config.description = value
+		case "HOMEPAGE":
+			config.homepage = value
+		case "LICENSE":
+			config.license = value
+		case "ROLE":
+			if value != "block" && value != "allow" {
+				return config, fmt.Errorf("ROLE: expected 'block' or 'allow', got '%s'", value)
+			}
+			config.role = value
+		case "FORMAT":
+			if value != "auto" && !isModuleFormat(value) {
+				return config, fmt.Errorf("FORMAT: expected 'auto' or one of %s, got '%s'", strings.Join(moduleFormats, ", "), value)
+			}
+			config.format = value
+		case "REDIRECT_IP":
+			if net.ParseIP(value) == nil {
+				return config, fmt.Errorf("REDIRECT_IP: invalid IP address '%s'", value)
+			}
+			config.redirectIP = value
+		case "FAILURE_POLICY":
+			if value != "fail" && value != "skip" {
+				return config, fmt.Errorf("FAILURE_POLICY: expected 'fail' or 'skip', got '%s'", value)
+			}
+			config.failurePolicy = value
+		case "URL":
+			config.url = value
+		case "MIRROR":
+			config.mirrors = append(config.mirrors, value)
+		case "MIRROR_STRATEGY":
+			if value != "order" && value != "race" {
+				return config, fmt.Errorf("MIRROR_STRATEGY: expected 'order' or 'race', got '%s'", value)
+			}
+			config.mirrorStrategy = value
+		case "REFRESH_INTERVAL":
+			config.refreshInterval, err = parseInterval(value)
+			if err != nil {
+				return config, fmt.Errorf("REFRESH_INTERVAL: %s", err.Error())
+			}
+		case "MAX_SIZE":
+			config.maxSize, err = parseSize(value)
+			if err != nil {
+				return config, fmt.Errorf("MAX_SIZE: %s", err.Error())
+			}
+		case "PROXY":
+			config.proxy = value
+		case "CA_BUNDLE":
+			config.caBundle = value
+		case "CLIENT_CERT":
+			config.clientCert = value
+		case "CLIENT_KEY":
+			config.clientKey = value
+		case "HEADER", "HEADER_FILE":
+			name, headerValue, found := strings.Cut(value, ":")
+			if !found || strings.TrimSpace(name) == "" {
+				return config, fmt.Errorf("%s: expected 'Name: value'", key)
+			}
+			header := webModuleHeader{name: strings.TrimSpace(name)}
+			if key == "HEADER" {
+				header.value = strings.TrimSpace(headerValue)
+			} else {
+				header.file = strings.TrimSpace(headerValue)
+			}
+			config.headers = append(config.headers, header)
+		case "SHA256":
+			config.sha256 = strings.ToLower(value)
+		case "SIGNATURE_URL":
+			config.signatureURL = value
+		case "SIGNATURE_TYPE":
+			if value != "minisign" && value != "openpgp" {
+				return config, fmt.Errorf("SIGNATURE_TYPE: expected 'minisign' or 'openpgp', got '%s'", value)
+			}
+			config.signatureType = value
+		case "PUBLIC_KEY":
+			config.publicKey = value
+		case "ALLOW_HTTP":
+			config.allowHTTP, err = strconv.ParseBool(value)
+			if err != nil {
+				return config, fmt.Errorf("ALLOW_HTTP: %s", err.Error())
+			}
+		case "TRUSTED":
+			config.trusted, err = strconv.ParseBool(value)
+			if err != nil {
+				return config, fmt.Errorf("TRUSTED: %s", err.Error())
+			}
+		case "COMPRESSION":
+			if value != "auto" && value != "none" && value != "gzip" && value != "bzip2" && value != "xz" && value != "zstd" {
+				return config, fmt.Errorf("COMPRESSION: expected 'auto', 'none', 'gzip', 'bzip2', 'xz' or 'zstd', got '%s'", value)
+			}
+			config.compression = value
+		case "ARCHIVE_MEMBER":
+			config.archiveMembers = append(config.archiveMembers, value)
+		case "AUTH_BASIC":
+			config.headers = append(config.headers, webModuleHeader{name: "Authorization", value: "Basic ", file: value, base64: true})
+		case "AUTH_BEARER":
+			config.headers = append(config.headers, webModuleHeader{name: "Authorization", value: "Bearer ", file: value})
+		default:
+			return config, fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+
+	if config.url == "" {
+		return config, errors.New("no URL found in module file")
+	}
+	if config.mirrorStrategy == "" {
+		config.mirrorStrategy = "order"
+	}
+	if config.signatureType == "" {
+		config.signatureType = "minisign"
+	}
+	if config.compression == "" {
+		config.compression = "auto"
+	}
+	if config.role == "" {
+		config.role = "block"
+	}
+	if config.format == "" {
+		config.format = "auto"
+	}
+	if config.signatureURL != "" && config.publicKey == "" {
+		return config, errors.New("SIGNATURE_URL is set but PUBLIC_KEY is missing")
+	}
+
+	return config, nil
+}
+
+// Keys are upper case words separated by underscores. Anything else (such as a
+// URL with a query string) is not considered a KEY=VALUE line.
+func isModuleKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, char := range key {
+		if (char < 'A' || char > 'Z') && (char < '0' || char > '9') && char != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// Applies the HTTP options set in a web module file on top of the ones from
+// the preferences file
+//
+// For secret headers, the value set in the module is only a prefix (such as
+// "Bearer ") and the rest is read from the secret file.
+func getWebModuleHTTPConfig(httpConfig httpClientConfig, moduleConfig webModuleConfig) (httpClientConfig, error) {
+	if moduleConfig.maxSize > 0 {
+		httpConfig.maxSize = moduleConfig.maxSize
+	}
+	if moduleConfig.proxy != "" {
+		httpConfig.httpProxy = moduleConfig.proxy
+		httpConfig.httpsProxy = moduleConfig.proxy
+		httpConfig.noProxy = ""
+	}
+	if moduleConfig.caBundle != "" {
+		httpConfig.caBundle = moduleConfig.caBundle
+	}
+	if moduleConfig.clientCert != "" {
+		httpConfig.clientCert = moduleConfig.clientCert
+		httpConfig.clientKey = moduleConfig.clientKey
+	}
+
+	httpConfig.headers = http.Header{}
+	for _, header := range moduleConfig.headers {
+		value := header.value
+		if header.file != "" {
+			secret, err := readSecretFile(header.file)
+			if err != nil {
+				return httpConfig, fmt.Errorf("header %s: %s", header.name, err.Error())
+			}
+			if header.base64 {
+				secret = base64.StdEncoding.EncodeToString([]byte(secret))
+			}
+			value += secret
+		}
+		httpConfig.headers.Add(header.name, value)
+	}
+
+	return httpConfig, nil
+}
+
+// Reads a secret (credentials, tokens,...) from a file. Relative paths are
+// looked up in the credentials directory. The file must belong to root and
+// must not be readable by other users.
+func readSecretFile(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(credentialsDir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %s", err.Error())
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("secret file %s must not be accessible by group or others (mode %o)", path, info.Mode().Perm())
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+		return "", fmt.Errorf("secret file %s must be owned by root", path)
+	}
+
+	secret, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %s", err.Error())
+	}
+
+	return strings.TrimSpace(string(secret)), nil
+}
+
+// Hides the password of URLs containing credentials, and the values of their
+// query string (where list providers often expect an access token), before
+// they are shown or stored
+func redactURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if parsedURL.RawQuery != "" {
+		query := parsedURL.Query()
+		for key := range query {
+			query[key] = []string{"xxxxx"}
+		}
+		parsedURL.RawQuery = query.Encode()
+	}
+	return parsedURL.Redacted()
+}
+
+// Returns the path to the content of a web module, decompressed and extracted
+// from its archive if needed. The content comes from the cached copy, if it is
+// younger than the module refresh interval, or from a fresh (and verified)
+// download.
+func fetchWebModule(moduleName string, moduleConfig webModuleConfig, httpConfig httpClientConfig, tmpDir string, refreshAll bool) (string, error) {
+	maxSize := httpConfig.maxSize
+	if moduleConfig.maxSize > 0 {
+		maxSize = moduleConfig.maxSize
+	}
+
+	lastFetched, cached := getWebModuleLastFetched(moduleName, moduleConfig)
+	if !refreshAll && cached && time.Since(lastFetched) < moduleConfig.refreshInterval {
+		if moduleConfig.sha256 != "" && verifySHA256(getWebModuleCacheFile(moduleName), moduleConfig.sha256) != nil {
+			showAttention("        > Cached copy does not match the module SHA256, downloading it again")
+		} else {
+			showInfo(fmt.Sprintf("        > Using cached copy fetched at %s (next due at %s)", lastFetched.Format(time.RFC1123), lastFetched.Add(moduleConfig.refreshInterval).Format(time.RFC1123)))
+			metadata := readWebModuleCacheMetadata(moduleName)
+			download := downloadResult{source: metadata["SOURCE"], contentType: metadata["CONTENT_TYPE"]}
+
+			contentFile := filepath.Join(tmpDir, moduleName+".content")
+			err := extractWebModuleContent(getWebModuleCacheFile(moduleName), contentFile, download, moduleConfig, maxSize)
+			if err != nil {
+				return "", fmt.Errorf("failed to extract content: %s", err.Error())
+			}
+			return contentFile, nil
+		}
+	}
+
+	return downloadWebModule(moduleName, moduleConfig, httpConfig, tmpDir, maxSize)
+}
+
+// Downloads, verifies and caches a web module, and returns the path to its
+// content. The content is decompressed and extracted while it is downloaded,
+// but only used once the download is verified. The downloaded file is cached
+// as served (compressed or archived), so that it matches its checksum and
+// signature.
+func downloadWebModule(moduleName string, moduleConfig webModuleConfig, httpConfig httpClientConfig, tmpDir string, maxSize int64) (string, error) {
+	moduleHTTPConfig, err := getWebModuleHTTPConfig(httpConfig, moduleConfig)
+	if err != nil {
+		return "", fmt.Errorf("invalid HTTP options: %s", err.Error())
+	}
+
+	sources := append([]string{moduleConfig.url}, moduleConfig.mirrors...)
+	for _, source := range append(sources, moduleConfig.signatureURL) {
+		if strings.HasPrefix(strings.ToLower(source), "http://") && moduleHTTPConfig.refusePlainHTTP && !moduleConfig.allowHTTP {
+			return "", fmt.Errorf("plain http:// source %s refused (set ALLOW_HTTP=true in the module to allow it)", redactURL(source))
+		}
+	}
+
+	extract := func(body io.Reader, file string, download downloadResult) error {
+		err := extractWebModuleStream(body, file+".content", download, moduleConfig, maxSize)
+		if err != nil {
+			return fmt.Errorf("failed to extract content: %s", err.Error())
+		}
+		return nil
+	}
+
+	moduleTempFile := filepath.Join(tmpDir, moduleName)
+	download, err := downloadFromSources(moduleTempFile, sources, moduleConfig.mirrorStrategy, moduleHTTPConfig, extract)
+	if err != nil {
+		return "", err
+	}
+	if len(sources) > 1 {
+		showInfo(fmt.Sprintf("        > Served by %s", redactURL(download.source)))
+	}
+
+	err = verifyWebModuleContent(moduleTempFile, moduleConfig, moduleHTTPConfig)
+	if err != nil {
+		return "", fmt.Errorf("content rejected: %s", err.Error())
+	}
+
+	err = storeWebModuleCache(moduleName, moduleConfig, moduleTempFile, download)
+	if err != nil {
+		showAttention("        > Failed to cache module " + moduleName + ": " + err.Error())
+	}
+
+	return moduleTempFile + ".content", nil
+}
+
+func loadWebModules(tmpDir string, refreshAll bool) ([]moduleResult, error) {
+	showInfoSectionTitle("Loading hosts from selected web sources")
+	time.Sleep(2 * time.Second)
+
+	var results []moduleResult
+
+	enabledWebModules, err := ioutil.ReadDir(filepath.Join(programDir, "modules", "web", "enabled"))
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error reading enabled web modules: " + err.Error()))
+	}
+
+	if len(enabledWebModules) == 0 {
+		showAttention("    > No module enabled")
+	}
+
+	httpConfig, err := getHTTPClientConfig()
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid HTTP option in preferences file: " + err.Error()))
+	}
+
+	blockAddresses, err := getBlockAddresses()
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid option in preferences file: " + err.Error()))
+	}
+
+	sanitizerReport, err := getSanitizerReport()
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid option in preferences file: SANITIZER_REPORT: " + err.Error()))
+	}
+
+	ownHostnames := getOwnHostnames()
+
+	i := 0
+	for _, module := range enabledWebModules {
+		if i >= 1 {
+			fmt.Println("")
+		}
+
+		orangeHex := "#ffa860"
+		orange := color.HEX(orangeHex)
+
+		showInfo(fmt.Sprintf("    > Loading module %s",orange.Sprintf(module.Name())))
+
+		moduleConfig, err := readWebModuleFile(filepath.Join(programDir, "modules", "web", "enabled",module.Name()))
+		if err != nil {
+			showError("        > Error getting module source for "+module.Name()+": "+err.Error())
+			// The failure policy is only known if it was read before the error
+			err = handleUnreachableModule(module.Name(), moduleConfig.failurePolicy)
+			if err != nil {
+				return results, err
+			}
+			continue
+		}
+		showInfo(fmt.Sprintf("        > Source: %s", redactURL(moduleConfig.url)))
+		for _, mirror := range moduleConfig.mirrors {
+			showInfo(fmt.Sprintf("        > Mirror: %s", redactURL(mirror)))
+		}
+
+		moduleTempFile, err := fetchWebModule(module.Name(), moduleConfig, httpConfig, tmpDir, refreshAll)
+		if err != nil {
+			showError(fmt.Sprintf("        > Source for "+module.Name()+" could not be loaded: %s", err.Error()))
+			err = handleUnreachableModule(module.Name(), moduleConfig.failurePolicy)
+			if err != nil {
+				return results, err
+			}
+			continue
+		}
+
+		format := moduleConfig.format
+		if format == "auto" {
+			format, err = detectModuleFormat(moduleTempFile)
+			if err != nil {
+				showError(fmt.Sprintf("        > List of "+module.Name()+" could not be loaded: %s", err.Error()))
+				err = handleUnreachableModule(module.Name(), moduleConfig.failurePolicy)
+				if err != nil {
+					return results, err
+				}
+				continue
+			}
+			showInfo("        > Detected format: " + format)
+		}
+
+		result, err := parseModuleContent(moduleTempFile, format)
+		if err != nil {
+			showError(fmt.Sprintf("        > List of "+module.Name()+" could not be loaded: %s", err.Error()))
+			err = handleUnreachableModule(module.Name(), moduleConfig.failurePolicy)
+			if err != nil {
+				return results, err
+			}
+			continue
+		}
+		result.kind = "web"
+		result.name = module.Name()
+
+		result.role = moduleConfig.role
+
+		validateModuleEntries(&result)
+		if !moduleConfig.trusted && moduleConfig.role != "allow" {
+			sanitizeModuleEntries(&result, ownHostnames, sanitizerReport)
+		}
+
+		redirectBlockingEntries(&result, getModuleBlockAddresses(blockAddresses, moduleConfig.redirectIP))
+
+		showSkippedRules(result)
+		results = append(results, result)
+
+		showSuccess(fmt.Sprintf("        > Done (%d entries)", len(result.entries)))
+		i++
+	}
+
+	return results, nil
+}
+
+// Decides what to do with a module whose source can not be reached (or, for
+// exec modules, whose command fails) according to the module failure policy
+// or, if it has none, to KEEP_ON_HOST_UNREACHABLE. An error is returned if the
+// update must be aborted.
+func handleUnreachableModule(moduleName string, failurePolicy string) error {
+	switch failurePolicy {
+	case "fail":
+		return errors.New(fmt.Sprintf("        > Error: failed to get module %s and its FAILURE_POLICY is set to 'fail'",moduleName))
+	case "skip":
+		showInfo("        > Skipping module...")
+		return nil
+	}
+
+	keepOnHostUnreachable_config, _ := getConfigValue("KEEP_ON_HOST_UNREACHABLE")
+	keepOnHostUnreachable, err := strconv.ParseBool(keepOnHostUnreachable_config)
+	if err != nil {
+		showAttention("            > Invalid option in preferences file for 'KEEP_ON_HOST_UNREACHABLE'.")
+		showInfo("        > Skipping module...")
+		return nil
+	}
+	if keepOnHostUnreachable == false {
+		return errors.New(fmt.Sprintf("        > Error: failed to get module %s and KEEP_ON_HOST_UNREACHABLE is set to 'false'",moduleName))
+	}
+
+	showInfo("        > Skipping module...")
+	return nil
+}
+
+type execModuleConfig struct {
+	command []string
+	timeout time.Duration
+}
+
+// An exec module file contains the command line to be run (split as a shell
+// would, but without running a shell) or a list of KEY=VALUE lines:
+//
+//   COMMAND=/usr/local/bin/inventory-hosts --format hosts
+//   TIMEOUT=1m
+func readExecModuleFile(filePath string, defaultTimeout time.Duration) (execModuleConfig, error) {
+	config := execModuleConfig{timeout: defaultTimeout}
+
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return config, err
+	}
+
+	commandLine := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found || !isModuleKey(key) {
+			commandLine = line
+			continue
+		}
+
+		switch key {
+		case "COMMAND":
+			commandLine = value
+		case "TIMEOUT":
+			config.timeout, err = parseInterval(value)
+			if err != nil {
+				return config, fmt.Errorf("TIMEOUT: %s", err.Error())
+			}
+		default:
+			return config, fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+
+	config.command, err = shellquote.Split(commandLine)
+	if err != nil {
+		return config, fmt.Errorf("invalid command: %s", err.Error())
+	}
+	if len(config.command) == 0 {
+		return config, errors.New("no command found in module file")
+	}
+
+	return config, nil
+}
+
+// Only the beginning of the error output of exec modules is kept, enough to
+// show why a command failed
+const maxExecStderrSize = 64 * 1024
+
+// Keeps the first bytes written to it and silently discards the rest, so that
+// the command writing to it is not interrupted
+type cappedBuffer struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buffer.Len(); room > 0 {
+		if len(p) > room {
+			b.buffer.Write(p[:room])
+		} else {
+			b.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// Runs the command of an exec module, writing its standard output to
+// outputFile. The command is killed if its output exceeds maxSize (0 means no
+// limit).
+func runExecModule(config execModuleConfig, outputFile string, maxSize int64) error {
+	// A timeout of 0 lets the command run until it exits
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if config.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), config.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var stdout io.Writer = out
+	limit := &limitedWriter{writer: out, remaining: maxSize, onExceeded: cancel}
+	if maxSize > 0 {
+		stdout = limit
+	}
+
+	stderr := &cappedBuffer{limit: maxExecStderrSize}
+	cmd := exec.CommandContext(ctx, config.command[0], config.command[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if limit.exceeded {
+		return fmt.Errorf("output exceeds the maximum size of %d bytes", maxSize)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", config.timeout)
+	}
+	if err != nil {
+		message := strings.TrimSpace(stderr.buffer.String())
+		if message != "" {
+			return fmt.Errorf("%s: %s", err.Error(), message)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func loadExecModules(tmpDir string) ([]moduleResult, error) {
+	showInfoSectionTitle("Loading hosts from exec modules")
+
+	var results []moduleResult
+
+	enabledExecModules, err := ioutil.ReadDir(filepath.Join(execModulesDir, "enabled"))
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error reading enabled exec modules: " + err.Error()))
+	}
+
+	if len(enabledExecModules) == 0 {
+		showAttention("    > No module enabled")
+	}
+
+	defaultTimeout, err := parseInterval(getConfigValueOrDefault("EXEC_TIMEOUT", "30s"))
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid EXEC_TIMEOUT option in preferences file: " + err.Error()))
+	}
+
+	maxSize, err := parseSize(getConfigValueOrDefault("EXEC_MAX_SIZE", "100M"))
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid EXEC_MAX_SIZE option in preferences file: " + err.Error()))
+	}
+
+	blockAddresses, err := getBlockAddresses()
+	if err != nil {
+		return results, errors.New(fmt.Sprintf("    > Error: invalid option in preferences file: " + err.Error()))
 	}
 
 	i := 0
-	for _, module := range enabledWebModules {
+	for _, module := range enabledExecModules {
 		if i >= 1 {
 			fmt.Println("")
 		}
@@ -365,61 +4626,57 @@ func loadWebModules(tmphosts_file string, tmpDir string) error {
 
 		showInfo(fmt.Sprintf("    > Loading module %s",orange.Sprintf(module.Name())))
 
-		moduleSource, err := readWebModuleFile(filepath.Join(programDir, "modules", "web", "enabled",module.Name()))
-		moduleSource = strings.TrimRight(moduleSource, "\n")
-		showInfo(fmt.Sprintf("        > Source: %s", moduleSource))
+		moduleConfig, err := readExecModuleFile(filepath.Join(execModulesDir, "enabled", module.Name()), defaultTimeout)
 		if err != nil {
-			showAttention("        > Error getting module source for "+module.Name()+": "+err.Error())
+			showAttention("        > Error getting module command for "+module.Name()+": "+err.Error())
 			continue
 		}
+		showInfo(fmt.Sprintf("        > Command: %s", shellquote.Join(moduleConfig.command...)))
 
-		moduleTempFile := filepath.Join(tmpDir, module.Name())
-		err = downloadFile(moduleTempFile, moduleSource)
+		moduleOutputFile := filepath.Join(tmpDir, "exec-" + module.Name())
+		err = runExecModule(moduleConfig, moduleOutputFile, maxSize)
 		if err != nil {
-			showError(fmt.Sprintf("        > Source for "+module.Name()+" could not be reached: %s", err.Error()))
-			keepOnHostUnreachable_config, _ := getConfigValue("KEEP_ON_HOST_UNREACHABLE")
-			keepOnHostUnreachable, err := strconv.ParseBool(keepOnHostUnreachable_config)
+			showError(fmt.Sprintf("        > Command for "+module.Name()+" failed: %s", err.Error()))
+			err = handleUnreachableModule(module.Name(), "")
 			if err != nil {
-				showAttention("            > Invalid option in preferences file for 'KEEP_ON_HOST_UNREACHABLE'.")
-				showInfo("        > Skipping module...")
-				continue
-			}
-			if keepOnHostUnreachable == false {
-				return errors.New(fmt.Sprintf("        > Error: failed to get module %s and KEEP_ON_HOST_UNREACHABLE is set to 'false'",module.Name()))
-			} else {
-				showInfo("        > Skipping module...")
+				return results, err
 			}
+			continue
 		}
 
-		insertLine(tmphosts_file,"")
-		insertComment(tmphosts_file,fmt.Sprintf("Hosts from web module '%s'",module.Name()))
-
-		moduleFile, err := os.Open(moduleTempFile)
+		result, err := parseModuleContent(moduleOutputFile, "hosts")
 		if err != nil {
-			showAttention("        > Error opening module file "+moduleTempFile+": "+err.Error())
+			showAttention("        > Error reading output of module "+module.Name()+": "+err.Error())
 			continue
 		}
-		defer moduleFile.Close()
-		scanner := bufio.NewScanner(moduleFile)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if !strings.HasPrefix(line, "#") && strings.TrimSpace(line) != "" {
-				insertLine(tmphosts_file,line)
-			}
-		}
-		insertLine(tmphosts_file,"")
+		result.kind = "exec"
+		result.name = module.Name()
 
-		showSuccess("        > Done")
+		validateModuleEntries(&result)
+		redirectBlockingEntries(&result, blockAddresses)
+
+		showSkippedRules(result)
+		results = append(results, result)
+
+		showSuccess(fmt.Sprintf("        > Done (%d entries)", len(result.entries)))
 		i++
 	}
 
-	return nil
+	return results, nil
 }
 
 
 func verifyInternetConnection() {
 	ip_test, err_test := getConfigValue("IP_TEST")
 
+	// Hosts that can only reach the internet through a proxy can not ping
+	// the test server, so the verification is skipped if IP_TEST is empty
+	if err_test == nil && strings.TrimSpace(ip_test) == "" {
+		showInfoSectionTitle("Internet connection verification")
+		showAttention("    > Skipped (IP_TEST is empty)")
+		return
+	}
+
 	showInfoSectionTitle(fmt.Sprintf("Internet connection verification (IP/Hostname: %s)",ip_test))
 
 	if err_test != nil {
@@ -451,6 +4708,15 @@ func verifyIntegrity() {
 		showError(fmt.Sprintf("    > Error: Web hosts directory not found at %s.", webModulesDir))
 		finishProgram(1)
 	}
+	if _, err := os.Stat(execModulesDir); os.IsNotExist(err) {
+		showInfo(fmt.Sprintf("    > Error: exec modules directory not found at %s. Creating one...", execModulesDir))
+		os.MkdirAll(filepath.Join(execModulesDir, "available"), 0755)
+		os.MkdirAll(filepath.Join(execModulesDir, "enabled"), 0755)
+	}
+	if _, err := os.Stat(allowlistDir); os.IsNotExist(err) {
+		showInfo(fmt.Sprintf("    > Error: allowlist directory not found at %s. Creating one...", allowlistDir))
+		os.MkdirAll(allowlistDir, 0755)
+	}
 	if _, err := os.Stat(configDir); os.IsNotExist(err) {
 		showError(fmt.Sprintf("    > Error: configuration directory not found at %s.", configDir))
 		finishProgram(1)
@@ -459,6 +4725,10 @@ func verifyIntegrity() {
 		showInfo(fmt.Sprintf("    > Error: backup directory not found at %s. Creating one...", backupDir))
 		os.Mkdir(backupDir, 0755)
 	}
+	if _, err := os.Stat(webCacheDir); os.IsNotExist(err) {
+		showInfo(fmt.Sprintf("    > Error: web modules cache directory not found at %s. Creating one...", webCacheDir))
+		os.MkdirAll(webCacheDir, 0755)
+	}
 	showSuccess("    > Passed")
 }
 
@@ -722,17 +4992,52 @@ func finishProgramMenu() {
 	}
 }
 
-func viewModule(moduleName string, webModule bool, localModule bool) error {
-	showInfo(fmt.Sprintf("Viewing module '%s'",moduleName))
-	var moduleDir string
+func getModuleDir(webModule bool, localModule bool, execModule bool) string {
 	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
+		return webModulesDir
+	} else if execModule {
+		return execModulesDir
+	}
+	return localModulesDir
+}
+
+// Verifies that exactly one of the module type options was given
+func verifyModuleTypeFlags(webModule bool, localModule bool, execModule bool) error {
+	selected := 0
+	for _, flag := range []bool{webModule, localModule, execModule} {
+		if flag {
+			selected++
+		}
+	}
+
+	if selected == 0 {
+		return errors.New("You need to insert at least an option: --web, --local or --exec")
+	} else if selected > 1 {
+		return errors.New("Options --web, --local and --exec are conflicting")
 	}
+	return nil
+}
+
+func viewModule(moduleName string, webModule bool, localModule bool, execModule bool, raw bool) error {
+	showInfo(fmt.Sprintf("Viewing module '%s'",moduleName))
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 
+	// Web modules are shown as a parsed manifest, unless the raw file is asked
+	if webModule && !raw {
+		moduleConfig, err := readWebModuleFile(availableModulePath)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("    > Not found")
+		} else if err != nil {
+			return fmt.Errorf("    > Invalid module file: %s", err.Error())
+		}
+
+		showWebModuleManifest(moduleConfig)
+		showSuccess("    > Done")
+		return nil
+	}
+
 	viewer, err := getConfigValue("DEFAULT_VIEWER")
 	if err != nil {
 		return errors.New("    > Failed to get DEFAULT_VIEWER config variable from preferences file")
@@ -759,14 +5064,74 @@ func viewModule(moduleName string, webModule bool, localModule bool) error {
 	return nil
 }
 
-func editModule(moduleName string, webModule bool, localModule bool) error {
-	showInfo(fmt.Sprintf("Editing module '%s'",moduleName))
-	var moduleDir string
-	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
+func showWebModuleManifest(config webModuleConfig) {
+	lightCopperHex := "#ffaa7f"
+	lightCopper := color.HEX(lightCopperHex)
+
+	field := func(name string, value string) {
+		if value != "" {
+			fmt.Println(fmt.Sprintf("    %s %s", lightCopper.Sprintf(name+":"), value))
+		}
+	}
+
+	field("Description", config.description)
+	field("Homepage", config.homepage)
+	field("License", config.license)
+	field("Role", config.role)
+	field("Format", config.format)
+	field("Source", redactURL(config.url))
+	for _, mirror := range config.mirrors {
+		field("Mirror", redactURL(mirror))
+	}
+	if len(config.mirrors) > 0 {
+		field("Mirror strategy", config.mirrorStrategy)
+	}
+	if config.refreshInterval > 0 {
+		field("Refresh interval", config.refreshInterval.String())
+	} else {
+		field("Refresh interval", "every update")
+	}
+	if config.failurePolicy != "" {
+		field("Failure policy", config.failurePolicy)
+	} else {
+		field("Failure policy", "KEEP_ON_HOST_UNREACHABLE preference")
+	}
+	field("Redirect IP", config.redirectIP)
+	field("SHA256", config.sha256)
+	if config.signatureURL != "" {
+		field("Signature", fmt.Sprintf("%s (%s)", redactURL(config.signatureURL), config.signatureType))
+		field("Public key", config.publicKey)
+	}
+	if config.allowHTTP {
+		field("Plain HTTP", "allowed")
+	}
+	if config.trusted {
+		field("Trusted", "yes (entries are not sanitized)")
+	}
+	field("Compression", config.compression)
+	for _, member := range config.archiveMembers {
+		field("Archive member", member)
+	}
+	if config.maxSize > 0 {
+		field("Maximum size", fmt.Sprintf("%d bytes", config.maxSize))
 	}
+	field("Proxy", redactURL(config.proxy))
+	field("CA bundle", config.caBundle)
+	field("Client certificate", config.clientCert)
+	field("Client key", config.clientKey)
+	for _, header := range config.headers {
+		// Values read from secret files are never shown
+		if header.file != "" {
+			field("Header", fmt.Sprintf("%s: %s<read from %s>", header.name, header.value, header.file))
+		} else {
+			field("Header", fmt.Sprintf("%s: %s", header.name, header.value))
+		}
+	}
+}
+
+func editModule(moduleName string, webModule bool, localModule bool, execModule bool) error {
+	showInfo(fmt.Sprintf("Editing module '%s'",moduleName))
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 
@@ -796,14 +5161,9 @@ func editModule(moduleName string, webModule bool, localModule bool) error {
 	return nil
 }
 
-func rmModule(moduleName string, webModule bool, localModule bool) error {
+func rmModule(moduleName string, webModule bool, localModule bool, execModule bool) error {
 	showInfo(fmt.Sprintf("Removing module '%s'",moduleName))
-	var moduleDir string
-	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
-	}
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 	enabledModulePath := filepath.Join(moduleDir,"enabled",moduleName)
@@ -836,17 +5196,22 @@ func rmModule(moduleName string, webModule bool, localModule bool) error {
 	}
 	showSuccess("        > Done")
 
+	// Along with its cached copy
+	if webModule {
+		showInfo("    > Removing cached copy")
+		err = os.RemoveAll(getWebModuleCacheDir(moduleName))
+		if err != nil {
+			return fmt.Errorf("        > Error when trying to remove cached copy: %s", err.Error())
+		}
+		showSuccess("        > Done")
+	}
+
 	return nil
 }
 
-func addModule(moduleName string, webModule bool, localModule bool) error {
+func addModule(moduleName string, webModule bool, localModule bool, execModule bool) error {
 	showInfo(fmt.Sprintf("Adding module '%s'",moduleName))
-	var moduleDir string
-	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
-	}
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 
@@ -875,14 +5240,9 @@ func addModule(moduleName string, webModule bool, localModule bool) error {
 	return nil
 }
 
-func enableModule(moduleName string, webModule bool, localModule bool) error {
+func enableModule(moduleName string, webModule bool, localModule bool, execModule bool) error {
 	showInfo(fmt.Sprintf("Enabling module '%s'",moduleName))
-	var moduleDir string
-	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
-	}
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 	enabledModulePath := filepath.Join(moduleDir,"enabled",moduleName)
@@ -909,14 +5269,9 @@ func enableModule(moduleName string, webModule bool, localModule bool) error {
 	return nil
 }
 
-func disableModule(moduleName string, webModule bool, localModule bool) error {
+func disableModule(moduleName string, webModule bool, localModule bool, execModule bool) error {
 	showInfo(fmt.Sprintf("Disabling module '%s'",moduleName))
-	var moduleDir string
-	if webModule {
-		moduleDir = webModulesDir
-	} else if localModule {
-		moduleDir = localModulesDir
-	}
+	moduleDir := getModuleDir(webModule, localModule, execModule)
 
 	availableModulePath := filepath.Join(moduleDir,"available",moduleName)
 	enabledModulePath := filepath.Join(moduleDir,"enabled",moduleName)
@@ -993,11 +5348,64 @@ func listWebModules() error {
 
 			fmt.Println(fmt.Sprintf("%s %s",module.Name(),blue.Sprintf("(enabled)")))
 		}
+
+		showWebModuleFetchInfo(module.Name())
+	}
+	return nil
+}
+
+func showWebModuleFetchInfo(moduleName string) {
+	moduleConfig, err := readWebModuleFile(filepath.Join(webModulesDir, "available", moduleName))
+	if err != nil {
+		showAttention("    > Invalid module file: " + err.Error())
+		return
+	}
+
+	if moduleConfig.role == "allow" {
+		showInfo("    > Role: allowlist")
+	}
+
+	lastFetched, cached := getWebModuleLastFetched(moduleName, moduleConfig)
+	if !cached {
+		showInfo("    > Last fetched: never | Next due: next update")
+	} else if moduleConfig.refreshInterval == 0 {
+		showInfo(fmt.Sprintf("    > Last fetched: %s | Next due: next update", lastFetched.Format(time.RFC1123)))
+	} else {
+		showInfo(fmt.Sprintf("    > Last fetched: %s | Next due: %s", lastFetched.Format(time.RFC1123), lastFetched.Add(moduleConfig.refreshInterval).Format(time.RFC1123)))
+	}
+
+	if cached && len(moduleConfig.mirrors) > 0 {
+		showInfo("    > Served by: " + readWebModuleCacheMetadata(moduleName)["SOURCE"])
+	}
+}
+
+func listExecModules() error {
+	showInfoSectionTitle("Listing exec modules")
+	availableExecModules, err := ioutil.ReadDir(execModulesDir + "/available")
+	if err != nil {
+		return errors.New(fmt.Sprintf("    > Error: failed to read exec modules directory: " + err.Error()))
+	}
+
+	for _, module := range availableExecModules {
+		_, err = os.Stat(execModulesDir + "/enabled/" + module.Name())
+		if os.IsNotExist(err) {
+			redHex := "#ff5050"
+			red := color.HEX(redHex)
+
+			fmt.Println(fmt.Sprintf("%s %s",module.Name(),red.Sprintf("(disabled)")))
+		} else if err != nil {
+			return fmt.Errorf("    > Error when trying to verify if module %s is enabled: %s", module.Name(), err.Error())
+		} else {
+			blueHex := "#55aaff"
+			blue := color.HEX(blueHex)
+
+			fmt.Println(fmt.Sprintf("%s %s",module.Name(),blue.Sprintf("(enabled)")))
+		}
 	}
 	return nil
 }
 
-func listModules(webModules bool, localModules bool, allModules bool) error {
+func listModules(webModules bool, localModules bool, execModules bool, allModules bool) error {
 	if localModules {
 		err := listLocalModules()
 		if err != nil {
@@ -1008,6 +5416,11 @@ func listModules(webModules bool, localModules bool, allModules bool) error {
 		if err != nil {
 			return errors.New(fmt.Sprintf(err.Error()))
 		}
+	} else if execModules {
+		err := listExecModules()
+		if err != nil {
+			return errors.New(fmt.Sprintf(err.Error()))
+		}
 	} else if allModules {
 		// List local modules
 		err := listLocalModules()
@@ -1022,6 +5435,14 @@ func listModules(webModules bool, localModules bool, allModules bool) error {
 		if err != nil {
 			return errors.New(fmt.Sprintf(err.Error()))
 		}
+
+		fmt.Println("")
+
+		// List exec modules
+		err = listExecModules()
+		if err != nil {
+			return errors.New(fmt.Sprintf(err.Error()))
+		}
 	}
 	return nil
 }
@@ -1095,6 +5516,7 @@ func main() {
 
 	var webModule bool
 	var localModule bool
+	var execModule bool
 	var allModule bool
 	var moduleName string
 
@@ -1107,18 +5529,17 @@ func main() {
 		Use:   "enable",
 		Short: "Enables a module",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-				} else if webModule && localModule {
-					return errors.New("Options --web and --local are conflicting")
-				}
-				if moduleName == "" {
-					return errors.New("Module name not provided")
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
+			}
+			if moduleName == "" {
+				return errors.New("Module name not provided")
 			}
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := enableModule(moduleName, webModule, localModule)
+			err := enableModule(moduleName, webModule, localModule, execModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1127,6 +5548,7 @@ func main() {
 
 	enableModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Enable web module")
 	enableModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Enable local module")
+	enableModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Enable exec module")
 	enableModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	enableModuleCmd.MarkFlagRequired("module")
 	enableModuleCmd.Flags().SetInterspersed(false)
@@ -1135,18 +5557,17 @@ func main() {
 		Use:   "disable [module]",
 		Short: "Disables a module",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-				} else if webModule && localModule {
-					return errors.New("Options --web and --local are conflicting")
-				}
-				if moduleName == "" {
-					return errors.New("Module name not provided")
-				}
-				return nil
-			},
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
+			}
+			if moduleName == "" {
+				return errors.New("Module name not provided")
+			}
+			return nil
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := disableModule(moduleName, webModule, localModule)
+			err := disableModule(moduleName, webModule, localModule, execModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1155,6 +5576,7 @@ func main() {
 
 	disableModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Disable web module")
 	disableModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Disable local module")
+	disableModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Disable exec module")
 	disableModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	disableModuleCmd.MarkFlagRequired("module")
 	disableModuleCmd.Flags().SetInterspersed(false)
@@ -1163,10 +5585,9 @@ func main() {
 		Use:   "add [module-file]",
 		Short: "Adds a module from a file",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-			} else if webModule && localModule {
-					return errors.New("Options --web and --local are conflicting")
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
 			}
 			if moduleName == "" {
 				return errors.New("Module name not provided")
@@ -1174,7 +5595,7 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := addModule(moduleName, webModule, localModule)
+			err := addModule(moduleName, webModule, localModule, execModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1183,6 +5604,7 @@ func main() {
 
 	addModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Add web module")
 	addModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Add local module")
+	addModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Add exec module")
 	addModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	addModuleCmd.MarkFlagRequired("module")
 	addModuleCmd.Flags().SetInterspersed(false)
@@ -1191,10 +5613,9 @@ func main() {
 		Use:   "rm [module]",
 		Short: "Removes a module",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-			} else if webModule && localModule {
-				return errors.New("Options --web and --local are conflicting")
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
 			}
 			if moduleName == "" {
 				return errors.New("Module name not provided")
@@ -1202,7 +5623,7 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := rmModule(moduleName, webModule, localModule)
+			err := rmModule(moduleName, webModule, localModule, execModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1211,6 +5632,7 @@ func main() {
 
 	rmModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Remove web module")
 	rmModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Remove local module")
+	rmModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Remove exec module")
 	rmModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	rmModuleCmd.MarkFlagRequired("module")
 	rmModuleCmd.Flags().SetInterspersed(false)
@@ -1219,10 +5641,9 @@ func main() {
 		Use:   "edit [module]",
 		Short: "Edits a module",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-			} else if webModule && localModule {
-				return errors.New("Options --web and --local are conflicting")
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
 			}
 			if moduleName == "" {
 				return errors.New("Module name not provided")
@@ -1230,7 +5651,7 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := editModule(moduleName, webModule, localModule)
+			err := editModule(moduleName, webModule, localModule, execModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1239,18 +5660,19 @@ func main() {
 
 	editModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Edit web module")
 	editModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Edit local module")
+	editModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Edit exec module")
 	editModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	editModuleCmd.MarkFlagRequired("module")
 	editModuleCmd.Flags().SetInterspersed(false)
 
+	var rawView bool
 	var viewModuleCmd = &cobra.Command{
 		Use:   "view [module]",
 		Short: "Views a module",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule {
-				return errors.New("You need to insert at least an option: --web or --local")
-			} else if webModule && localModule {
-				return errors.New("Options --web and --local are conflicting")
+			err := verifyModuleTypeFlags(webModule, localModule, execModule)
+			if err != nil {
+				return err
 			}
 			if moduleName == "" {
 				return errors.New("Module name not provided")
@@ -1258,7 +5680,7 @@ func main() {
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := viewModule(moduleName, webModule, localModule)
+			err := viewModule(moduleName, webModule, localModule, execModule, rawView)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1267,6 +5689,8 @@ func main() {
 
 	viewModuleCmd.Flags().BoolVarP(&webModule, "web", "w", false, "View web module")
 	viewModuleCmd.Flags().BoolVarP(&localModule, "local", "l", false, "View local module")
+	viewModuleCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "View exec module")
+	viewModuleCmd.Flags().BoolVar(&rawView, "raw", false, "Open the web module file with the default viewer instead of showing its parsed manifest")
 	viewModuleCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
 	viewModuleCmd.MarkFlagRequired("module")
 	viewModuleCmd.Flags().SetInterspersed(false)
@@ -1275,21 +5699,21 @@ func main() {
 		Use:   "list [module]",
 		Short: "Lists modules",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			if !webModule && !localModule && !allModule {
-				return errors.New("You need to insert at least an option: --web, --local or --all")
-			} else if webModule && localModule && allModule {
-				return errors.New("Options --web and --local and --all are conflicting")
-			} else if webModule && localModule {
-				return errors.New("Options --web and --local are conflicting")
-			} else if webModule && allModule {
-				return errors.New("Options --web and --all are conflicting")
-			} else if localModule && allModule {
-				return errors.New("Options --local and --all are conflicting")
+			selected := 0
+			for _, flag := range []bool{webModule, localModule, execModule, allModule} {
+				if flag {
+					selected++
+				}
+			}
+			if selected == 0 {
+				return errors.New("You need to insert at least an option: --web, --local, --exec or --all")
+			} else if selected > 1 {
+				return errors.New("Options --web, --local, --exec and --all are conflicting")
 			}
 			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := listModules(webModule, localModule, allModule)
+			err := listModules(webModule, localModule, execModule, allModule)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 			}
@@ -1298,10 +5722,127 @@ func main() {
 
 	listModulesCmd.Flags().BoolVarP(&webModule, "web", "w", false, "List web modules")
 	listModulesCmd.Flags().BoolVarP(&localModule, "local", "l", false, "List local modules")
+	listModulesCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "List exec modules")
 	listModulesCmd.Flags().BoolVarP(&allModule, "all", "a", false, "List all modules")
 	listModulesCmd.Flags().SetInterspersed(false)
 
+	var sortEntries bool
+	var checkFormat bool
+	var fmtModulesCmd = &cobra.Command{
+		Use:   "fmt",
+		Short: "Rewrites local modules in a canonical form",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if !localModule {
+				return errors.New("You need to insert the --local option (only local modules can be formatted)")
+			}
+			if moduleName == "" && !allModule {
+				return errors.New("You need to insert an option: --module or --all")
+			} else if moduleName != "" && allModule {
+				return errors.New("Options --module and --all are conflicting")
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			changed, err := fmtModules(moduleName, allModule, sortEntries, checkFormat)
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+				finishProgram(1)
+			}
+			if checkFormat && changed > 0 {
+				finishProgram(1)
+			}
+		},
+	}
+
+	fmtModulesCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Format local modules")
+	fmtModulesCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Module name")
+	fmtModulesCmd.Flags().BoolVarP(&allModule, "all", "a", false, "Format all local modules")
+	fmtModulesCmd.Flags().BoolVarP(&sortEntries, "sort", "s", false, "Sort entries by address, then hostname")
+	fmtModulesCmd.Flags().BoolVar(&checkFormat, "check", false, "Only report the modules that would be changed (exits with a non-zero status if any)")
+	fmtModulesCmd.Flags().SetInterspersed(false)
+
+	var allowlistCmd = &cobra.Command{
+		Use:   "allowlist",
+		Short: "Manages the rules keeping hostnames from being blocked by web and exec modules",
+	}
+
+	var allowlistFile string
+	var addAllowRuleCmd = &cobra.Command{
+		Use:   "add [rule]",
+		Short: "Adds an allowlist rule (hostname, *.wildcard or /regex/)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := addAllowRule(args[0], allowlistFile)
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+			}
+		},
+	}
+
+	addAllowRuleCmd.Flags().StringVarP(&allowlistFile, "file", "f", "default", "Allowlist file the rule is added to")
+
+	var rmAllowRuleCmd = &cobra.Command{
+		Use:   "rm [rule]",
+		Short: "Removes an allowlist rule",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := rmAllowRule(args[0])
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+			}
+		},
+	}
+
+	var listAllowRulesCmd = &cobra.Command{
+		Use:   "list",
+		Short: "Lists allowlist rules",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := listAllowRules()
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+			}
+		},
+	}
+
+	var testAllowRulesCmd = &cobra.Command{
+		Use:   "test [domain]",
+		Short: "Shows the allowlist rules matching a domain",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := testAllowRules(args[0])
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+			}
+		},
+	}
+
+	var lintHostsFilePath string
+	var lintCmd = &cobra.Command{
+		Use:   "lint",
+		Short: "Checks modules (all of them by default) and hosts files for problems",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			errorCount, err := lint(localModule, webModule, execModule, moduleName, lintHostsFilePath)
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+				finishProgram(1)
+			}
+			if errorCount > 0 {
+				finishProgram(1)
+			}
+		},
+	}
+
+	lintCmd.Flags().BoolVarP(&localModule, "local", "l", false, "Lint local modules")
+	lintCmd.Flags().BoolVarP(&webModule, "web", "w", false, "Lint web modules")
+	lintCmd.Flags().BoolVarP(&execModule, "exec", "e", false, "Lint exec modules")
+	lintCmd.Flags().StringVarP(&moduleName, "module", "m", "", "Lint only the module with this name")
+	lintCmd.Flags().StringVar(&lintHostsFilePath, "hosts-file", "", "Lint a file in the /etc/hosts syntax (e.g. /etc/hosts)")
+
 	var noInteractive bool
+	var refreshAll bool
+	var verbose bool
 	var updateHostsFileCmd = &cobra.Command{
 		Use:   "update",
 		Short: "Updates the /etc/hosts file according to enabled modules" ,
@@ -1344,11 +5885,37 @@ func main() {
 
 			fmt.Println("")
 
-			insertHostname(tmphosts_file)
+			err = insertHostname(tmphosts_file)
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			fmt.Println("")
+
+			localResults, err := loadLocalModules()
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			fmt.Println("")
+
+			webResults, err := loadWebModules(temp_dir, refreshAll)
+			if err != nil {
+				showError(fmt.Sprintf(err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
 
 			fmt.Println("")
 
-			err = loadLocalModules(tmphosts_file)
+			execResults, err := loadExecModules(temp_dir)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 				restoreBackup(backup_file)
@@ -1358,7 +5925,59 @@ func main() {
 
 			fmt.Println("")
 
-			err = loadWebModules(tmphosts_file, temp_dir)
+			allowRules, err := readAllowlistRules()
+			if err != nil {
+				showError(fmt.Sprintf("    > Error reading allowlist files: %s", err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			moduleOrder, err := getModuleOrder()
+			if err != nil {
+				showError(fmt.Sprintf("    > Error: invalid MODULE_ORDER option in preferences file: %s", err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			var results []moduleResult
+			for _, result := range orderModuleResults(append(append(localResults, webResults...), execResults...), moduleOrder) {
+				allowRules = append(allowRules, getModuleAllowRules(result)...)
+				if result.role != "allow" {
+					results = append(results, result)
+				}
+			}
+			conflictPolicy, err := getConflictPolicy()
+			if err != nil {
+				showError(fmt.Sprintf("    > Error: invalid CONFLICT_POLICY option in preferences file: %s", err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			conflicts := mergeModuleResults(results, allowRules, conflictPolicy)
+			showConflicts(conflicts, conflictPolicy)
+			fmt.Println("")
+			if conflictPolicy == "error" && len(conflicts) > 0 {
+				showError(fmt.Sprintf("    > Error: %d hostnames are mapped to different addresses (see CONFLICT_POLICY)", len(conflicts)))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+
+			ipv6TwinAddress, err := getIPv6TwinAddress()
+			if err != nil {
+				showError(fmt.Sprintf("    > Error: invalid option in preferences file: %s", err.Error()))
+				restoreBackup(backup_file)
+				removeTmpDir(temp_dir)
+				finishProgram(1)
+			}
+			if ipv6TwinAddress != "" {
+				addIPv6TwinEntries(results, ipv6TwinAddress)
+			}
+
+			err = writeModules(tmphosts_file, results)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
 				restoreBackup(backup_file)
@@ -1368,6 +5987,10 @@ func main() {
 
 			fmt.Println("")
 
+			showRunSummary(results, allowRules, verbose)
+
+			fmt.Println("")
+
 			err = overwriteHostsFileWithTempFile(tmphosts_file)
 			if err != nil {
 				showError(fmt.Sprintf(err.Error()))
@@ -1393,6 +6016,8 @@ func main() {
 		},
 	}
 	updateHostsFileCmd.Flags().BoolVar(&noInteractive, "no-interactive", false, "Skip the interactive finish program menu")
+	updateHostsFileCmd.Flags().BoolVar(&refreshAll, "refresh-all", false, "Download all web modules, ignoring their refresh intervals")
+	updateHostsFileCmd.Flags().BoolVar(&verbose, "verbose", false, "List, in the summary, the other modules each written hostname is also in")
 
 	// Add Cobra commands
 	rootCmd.AddCommand(enableServiceCmd)
@@ -1407,7 +6032,14 @@ func main() {
 	modulesCmd.AddCommand(editModuleCmd)
 	modulesCmd.AddCommand(viewModuleCmd)
 	modulesCmd.AddCommand(listModulesCmd)
+	modulesCmd.AddCommand(fmtModulesCmd)
 	rootCmd.AddCommand(modulesCmd)
+	allowlistCmd.AddCommand(addAllowRuleCmd)
+	allowlistCmd.AddCommand(rmAllowRuleCmd)
+	allowlistCmd.AddCommand(listAllowRulesCmd)
+	allowlistCmd.AddCommand(testAllowRulesCmd)
+	rootCmd.AddCommand(allowlistCmd)
+	rootCmd.AddCommand(lintCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)